@@ -1,3 +1,16 @@
 module github.com/natrimmer/claude_commit
 
 go 1.21
+
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/zalando/go-keyring v0.2.3
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/alessio/shellescape v1.4.1 // indirect
+	github.com/danieljoos/wincred v1.2.0 // indirect
+	github.com/godbus/dbus/v5 v5.1.0 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+)
@@ -1,16 +1,35 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/BurntSushi/toml"
+	"github.com/zalando/go-keyring"
+	"gopkg.in/yaml.v3"
 )
 
 // Version information - can be set at build time with ldflags
@@ -47,16 +66,204 @@ const (
 	BgWhite   = "\033[47m"
 )
 
+// Error codes are stable identifiers printed with an error, e.g.
+// "[NO_STAGED_CHANGES] no staged changes found", for scripts to match on
+const (
+	CodeConfigMissing   = "CONFIG_MISSING"
+	CodeNoStagedChanges = "NO_STAGED_CHANGES"
+	CodeAPIAuth         = "API_AUTH"
+	CodeAPIRate         = "API_RATE_LIMIT"
+	CodeAPITimeout      = "API_TIMEOUT"
+	CodeAPIError        = "API_ERROR"
+	CodeAPIIncomplete   = "API_INCOMPLETE"
+	CodeNoUpstream      = "NO_UPSTREAM"
+	CodeNoCommits       = "NO_COMMITS"
+	CodeSecretsDetected = "SECRETS_DETECTED"
+	CodeInvalidAPIKey   = "INVALID_API_KEY"
+	CodeTooManyFiles    = "TOO_MANY_FILES"
+	CodeUnknownRef      = "UNKNOWN_REF"
+	CodeNoGitIdentity   = "NO_GIT_IDENTITY"
+	CodeGitNotFound     = "GIT_NOT_FOUND"
+)
+
+// CommitError attaches an error code to err. Its message is err's, so
+// wrapping an error in one doesn't change what the user sees.
+type CommitError struct {
+	Code string
+	Err  error
+}
+
+func (e *CommitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CommitError) Unwrap() error {
+	return e.Err
+}
+
+// errorCode returns the code attached to err, or an empty string
+func errorCode(err error) string {
+	var commitErr *CommitError
+	if errors.As(err, &commitErr) {
+		return commitErr.Code
+	}
+	return ""
+}
+
+// Errors with a known cause, used to suggest a fix to the user
+var (
+	ErrConfigNotFound  = &CommitError{Code: CodeConfigMissing, Err: errors.New("error reading config file")}
+	ErrNoStagedChanges = &CommitError{Code: CodeNoStagedChanges, Err: errors.New("no staged changes found")}
+	ErrAPIAuth         = &CommitError{Code: CodeAPIAuth, Err: errors.New("API authentication failed")}
+	ErrAPIRate         = &CommitError{Code: CodeAPIRate, Err: errors.New("API rate limit exceeded")}
+	ErrNoUpstream      = &CommitError{Code: CodeNoUpstream, Err: errors.New("current branch has no upstream")}
+	ErrAPITimeout      = &CommitError{Code: CodeAPITimeout, Err: errors.New("API request timed out")}
+	ErrAPIIncomplete   = &CommitError{Code: CodeAPIIncomplete, Err: errors.New("incomplete response from API, please retry")}
+	ErrNoCommits       = &CommitError{Code: CodeNoCommits, Err: errors.New("no commits to amend")}
+	ErrSecretNotFound  = errors.New("secret not found")
+	ErrNoClipboard     = errors.New("no clipboard command found")
+	ErrSecretsDetected = &CommitError{Code: CodeSecretsDetected, Err: errors.New("possible secrets in the staged changes")}
+	ErrInvalidAPIKey   = &CommitError{Code: CodeInvalidAPIKey, Err: errors.New("malformed API key")}
+	ErrTooManyFiles    = &CommitError{Code: CodeTooManyFiles, Err: errors.New("too many changed files")}
+	ErrUnknownRef      = &CommitError{Code: CodeUnknownRef, Err: errors.New("unknown git ref")}
+	ErrNoGitIdentity   = &CommitError{Code: CodeNoGitIdentity, Err: errors.New("git user.name and user.email are not set")}
+	ErrGitNotFound     = &CommitError{Code: CodeGitNotFound, Err: errors.New("git is not installed or not on PATH")}
+)
+
 // Domain types
 type Config struct {
-	ApiKey string `json:"api_key"`
-	Model  string `json:"model"`
+	ApiKey string `json:"api_key" yaml:"api_key" toml:"api_key"`
+	Model  string `json:"model" yaml:"model" toml:"model"`
+
+	// ContextCommand is a shell command whose output is added to the prompt
+	ContextCommand string `json:"context_command,omitempty" yaml:"context_command,omitempty" toml:"context_command,omitempty"`
+	// PromptTemplate is the path to a text/template file replacing the built-in prompt
+	PromptTemplate string `json:"prompt_template,omitempty" yaml:"prompt_template,omitempty" toml:"prompt_template,omitempty"`
+	// AsciiOnly strips or transliterates non-ASCII characters from generated messages
+	AsciiOnly bool `json:"ascii_only,omitempty" yaml:"ascii_only,omitempty" toml:"ascii_only,omitempty"`
+	// IgnoreWhitespace leaves whitespace-only changes out of the diff (git diff -w)
+	IgnoreWhitespace bool `json:"ignore_whitespace,omitempty" yaml:"ignore_whitespace,omitempty" toml:"ignore_whitespace,omitempty"`
+	// Signoff adds a Signed-off-by trailer with the git identity, like -signoff
+	Signoff bool `json:"signoff,omitempty" yaml:"signoff,omitempty" toml:"signoff,omitempty"`
+	// MaxLineLength truncates longer diff lines (e.g. minified files); 0 uses DefaultMaxLineLength
+	MaxLineLength int `json:"max_line_length,omitempty" yaml:"max_line_length,omitempty" toml:"max_line_length,omitempty"`
+	// UserAgent overrides the default claude-commit/<version> User-Agent header
+	UserAgent string `json:"user_agent,omitempty" yaml:"user_agent,omitempty" toml:"user_agent,omitempty"`
+	// ExtraHeaders are added to every API request after the defaults, for
+	// gateways that need their own auth or routing headers. A header named
+	// here replaces the default with the same name.
+	ExtraHeaders map[string]string `json:"extra_headers,omitempty" yaml:"extra_headers,omitempty" toml:"extra_headers,omitempty"`
+	// TemplatesByType maps a commit type (or "default") to a text/template
+	// that shapes the final message, e.g. adding a "Root cause:" footer to fixes
+	TemplatesByType map[string]string `json:"templates_by_type,omitempty" yaml:"templates_by_type,omitempty" toml:"templates_by_type,omitempty"`
+	// SubjectCase is the casing of the description: lower (default), sentence or preserve
+	SubjectCase string `json:"subject_case,omitempty" yaml:"subject_case,omitempty" toml:"subject_case,omitempty"`
+	// CommitPrefix, such as "[skip ci]", is added to every generated subject
+	CommitPrefix string `json:"commit_prefix,omitempty" yaml:"commit_prefix,omitempty" toml:"commit_prefix,omitempty"`
+	// PrefixPosition places CommitPrefix before the type (default) or after it
+	PrefixPosition string `json:"prefix_position,omitempty" yaml:"prefix_position,omitempty" toml:"prefix_position,omitempty"`
+	// BaseURL points API requests at a gateway or proxy; empty uses DefaultBaseURL
+	BaseURL string `json:"base_url,omitempty" yaml:"base_url,omitempty" toml:"base_url,omitempty"`
+	// APIVersion is sent as the anthropic-version header; empty uses DefaultAPIVersion
+	APIVersion string `json:"api_version,omitempty" yaml:"api_version,omitempty" toml:"api_version,omitempty"`
+	// CustomTypes are extra commit types, such as deps or security, added to the prompt
+	CustomTypes []string `json:"custom_types,omitempty" yaml:"custom_types,omitempty" toml:"custom_types,omitempty"`
+	// MaxSubjectLength is the longest first line asked for; 0 uses DefaultMaxSubjectLength
+	MaxSubjectLength int `json:"max_subject_length,omitempty" yaml:"max_subject_length,omitempty" toml:"max_subject_length,omitempty"`
+	// MaxFiles is the most changed files a message is generated for; 0 uses DefaultMaxFiles
+	MaxFiles int `json:"max_files,omitempty" yaml:"max_files,omitempty" toml:"max_files,omitempty"`
+	// Temperature and TopP are sent to the API when non-zero; 0 keeps the API default
+	Temperature float64 `json:"temperature,omitempty" yaml:"temperature,omitempty" toml:"temperature,omitempty"`
+	TopP        float64 `json:"top_p,omitempty" yaml:"top_p,omitempty" toml:"top_p,omitempty"`
+	// Provider selects the API: anthropic (default) or openai for OpenAI-compatible endpoints
+	Provider string `json:"provider,omitempty" yaml:"provider,omitempty" toml:"provider,omitempty"`
+	// TicketPattern finds the ticket ID in a branch name for -ticket-from-branch;
+	// empty uses DefaultTicketPattern. A capture group, if any, is the ID
+	TicketPattern string `json:"ticket_pattern,omitempty" yaml:"ticket_pattern,omitempty" toml:"ticket_pattern,omitempty"`
+	// CacheTTL is how long generated messages are reused for an identical
+	// prompt, as a duration like "30m"; empty uses DefaultCacheTTL
+	CacheTTL string `json:"cache_ttl,omitempty" yaml:"cache_ttl,omitempty" toml:"cache_ttl,omitempty"`
+	// Language is what the description and body are written in, e.g. Spanish;
+	// empty means English. Types and trailers stay in English
+	Language string `json:"language,omitempty" yaml:"language,omitempty" toml:"language,omitempty"`
+	// HTTPTimeout caps each HTTP request, as a duration like "90s"; empty
+	// uses DefaultHTTPTimeout
+	HTTPTimeout string `json:"http_timeout,omitempty" yaml:"http_timeout,omitempty" toml:"http_timeout,omitempty"`
+	// Rules turns the subject line rules in the prompt on and off; nil
+	// keeps every default
+	Rules *CommitRules `json:"rules,omitempty" yaml:"rules,omitempty" toml:"rules,omitempty"`
+}
+
+// CommitRules are the subject line rules given to the model. Unset fields
+// keep the default, so an empty rule set behaves like none at all.
+type CommitRules struct {
+	// MaxLength is the longest first line asked for; 0 falls back to
+	// Config.MaxSubjectLength
+	MaxLength int `json:"max_length,omitempty" yaml:"max_length,omitempty" toml:"max_length,omitempty"`
+	// Imperative asks for "add feature" rather than "Added feature"; default true
+	Imperative *bool `json:"imperative,omitempty" yaml:"imperative,omitempty" toml:"imperative,omitempty"`
+	// Lowercase asks for an all lowercase subject unless Config.SubjectCase
+	// says otherwise; default true
+	Lowercase *bool `json:"lowercase,omitempty" yaml:"lowercase,omitempty" toml:"lowercase,omitempty"`
+	// NoTrailingPeriod asks for no period at the end of the subject; default true
+	NoTrailingPeriod *bool `json:"no_trailing_period,omitempty" yaml:"no_trailing_period,omitempty" toml:"no_trailing_period,omitempty"`
+}
+
+// describeRules lists the rules r sets, e.g. "max length 72, imperative
+// off", or returns an empty string when it sets none
+func describeRules(r *CommitRules) string {
+	if r == nil {
+		return ""
+	}
+	var parts []string
+	if r.MaxLength > 0 {
+		parts = append(parts, fmt.Sprintf("max length %d", r.MaxLength))
+	}
+	for _, rule := range []struct {
+		name  string
+		value *bool
+	}{
+		{"imperative", r.Imperative},
+		{"lowercase", r.Lowercase},
+		{"no trailing period", r.NoTrailingPeriod},
+	} {
+		if rule.value == nil {
+			continue
+		}
+		state := "on"
+		if !*rule.value {
+			state = "off"
+		}
+		parts = append(parts, rule.name+" "+state)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ruleEnabled reports whether a rule is on, treating unset as on
+func ruleEnabled(rule *bool) bool {
+	return rule == nil || *rule
+}
+
+func (r *CommitRules) imperative() bool {
+	return r == nil || ruleEnabled(r.Imperative)
+}
+
+func (r *CommitRules) lowercase() bool {
+	return r == nil || ruleEnabled(r.Lowercase)
+}
+
+func (r *CommitRules) noTrailingPeriod() bool {
+	return r == nil || ruleEnabled(r.NoTrailingPeriod)
 }
 
 type AnthropicRequest struct {
-	Model     string    `json:"model"`
-	Messages  []Message `json:"messages"`
-	MaxTokens int       `json:"max_tokens"`
+	Model       string    `json:"model"`
+	System      string    `json:"system,omitempty"`
+	Messages    []Message `json:"messages"`
+	MaxTokens   int       `json:"max_tokens"`
+	Temperature float64   `json:"temperature,omitempty"`
+	TopP        float64   `json:"top_p,omitempty"`
+	Stream      bool      `json:"stream,omitempty"`
 }
 
 type Message struct {
@@ -64,18 +271,51 @@ type Message struct {
 	Content string `json:"content"`
 }
 
+// Message roles used by the Anthropic Messages API. Other providers name
+// their roles differently, so keep these out of the prompt-building code.
+const (
+	AnthropicRoleUser      = "user"
+	AnthropicRoleAssistant = "assistant"
+)
+
+// Message roles used by OpenAI-compatible chat completions
+const (
+	OpenAIRoleSystem    = "system"
+	OpenAIRoleUser      = "user"
+	OpenAIRoleAssistant = "assistant"
+)
+
+// ModelsResponse is the body of GET /v1/models
+type ModelsResponse struct {
+	Data []ModelInfo `json:"data"`
+}
+
+type ModelInfo struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name"`
+}
+
 type AnthropicResponse struct {
-	Content []struct {
-		Text string `json:"text"`
-	} `json:"content"`
+	Content []ContentBlock `json:"content"`
+}
+
+// ContentBlock is a single block of a response; text blocks carry Text and
+// tool_use blocks carry structured Input
+type ContentBlock struct {
+	Type  string          `json:"type,omitempty"`
+	Text  string          `json:"text,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
 }
 
 // Interfaces for dependency injection
 type FileSystem interface {
 	UserHomeDir() (string, error)
+	Getenv(key string) string
 	MkdirAll(path string, perm os.FileMode) error
 	WriteFile(filename string, data []byte, perm os.FileMode) error
 	ReadFile(filename string) ([]byte, error)
+	Remove(path string) error
+	ListDir(path string) ([]string, error)
 }
 
 type HTTPClient interface {
@@ -84,7 +324,69 @@ type HTTPClient interface {
 
 type GitClient interface {
 	GetStagedDiff() (string, error)
+	GetStagedDiffOptions(ignoreWhitespace bool) (string, error)
 	GetStagedFiles() (string, error)
+	GetStagedSummary() (string, error)
+	GetRepoRoot() (string, error)
+	GetGitDir() (string, error)
+	GetCommitSubject(sha string) (string, error)
+	GetCommitDiff(sha string) (string, error)
+	GetCommitRange(rangeSpec string) ([]string, error)
+	GetUnpushedCommits() ([]string, error)
+	StageAll() error
+	StageTracked() error
+	Commit(message string, opts CommitOptions) error
+	GetLastCommitDiff() (string, error)
+	AmendCommit(message string, opts CommitOptions) error
+	GetRecentCommits(n int) ([]string, error)
+	GetCurrentBranch() (string, error)
+	GetDiffAgainst(ref string) (string, error)
+	GetFilesAgainst(ref string) (string, error)
+	GetAuthorIdentity() (name, email string, err error)
+	GetUntrackedFiles() ([]string, error)
+}
+
+// CommitOptions are passed through to git commit
+type CommitOptions struct {
+	NoVerify bool // Skip the pre-commit and commit-msg hooks (--no-verify)
+}
+
+// args returns the git commit flags for opts
+func (opts CommitOptions) args() []string {
+	if opts.NoVerify {
+		return []string{"--no-verify"}
+	}
+	return nil
+}
+
+type CommandRunner interface {
+	Run(ctx context.Context, name string, args ...string) (string, error)
+}
+
+// CommitGenerator sends a prompt to a model provider and returns its reply.
+// system carries standing instructions and may be empty.
+type CommitGenerator interface {
+	Generate(ctx context.Context, config Config, system, prompt string, maxTokens int) (string, error)
+	// GenerateConversation is Generate for messages built by
+	// buildConversation, returning the next assistant reply
+	GenerateConversation(ctx context.Context, config Config, system string, messages []Message, maxTokens int) (string, error)
+}
+
+// Editor lets the user change text, normally in $EDITOR
+type Editor interface {
+	Edit(initial string) (string, error)
+}
+
+// Clipboard puts text on the system clipboard
+type Clipboard interface {
+	Copy(text string) error
+}
+
+// SecretStore keeps secrets such as the API key out of the config file
+type SecretStore interface {
+	GetSecret(key string) (string, error)
+	SetSecret(key, value string) error
+	DeleteSecret(key string) error
 }
 
 type Printer interface {
@@ -92,6 +394,9 @@ type Printer interface {
 	PrintSuccess(msg string)
 	PrintError(msg string)
 	PrintWarning(msg string)
+	// PrintInline prints msg without starting a new line, e.g. for
+	// streamed text
+	PrintInline(msg string)
 }
 
 // Real implementations
@@ -101,6 +406,10 @@ func (fs *RealFileSystem) UserHomeDir() (string, error) {
 	return os.UserHomeDir()
 }
 
+func (fs *RealFileSystem) Getenv(key string) string {
+	return os.Getenv(key)
+}
+
 func (fs *RealFileSystem) MkdirAll(path string, perm os.FileMode) error {
 	return os.MkdirAll(path, perm)
 }
@@ -113,10 +422,63 @@ func (fs *RealFileSystem) ReadFile(filename string) ([]byte, error) {
 	return os.ReadFile(filename)
 }
 
+func (fs *RealFileSystem) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (fs *RealFileSystem) ListDir(path string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names, nil
+}
+
+// KeyringService is the service name secrets are stored under in the OS keyring
+const KeyringService = "claude-commit"
+
+// KeyringSecretStore stores secrets in the OS keyring (Keychain, Secret
+// Service or Windows Credential Manager)
+type KeyringSecretStore struct{}
+
+func (ks *KeyringSecretStore) GetSecret(key string) (string, error) {
+	secret, err := keyring.Get(KeyringService, key)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return "", ErrSecretNotFound
+	}
+	return secret, err
+}
+
+func (ks *KeyringSecretStore) SetSecret(key, value string) error {
+	return keyring.Set(KeyringService, key, value)
+}
+
+func (ks *KeyringSecretStore) DeleteSecret(key string) error {
+	err := keyring.Delete(KeyringService, key)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return ErrSecretNotFound
+	}
+	return err
+}
+
 type RealGitClient struct{}
 
 func (gc *RealGitClient) GetStagedDiff() (string, error) {
-	cmd := exec.Command("git", "diff", "--staged")
+	return gc.GetStagedDiffOptions(false)
+}
+
+// GetStagedDiffOptions returns the staged diff, leaving out whitespace-only
+// changes when ignoreWhitespace is set
+func (gc *RealGitClient) GetStagedDiffOptions(ignoreWhitespace bool) (string, error) {
+	args := []string{"diff", "--staged"}
+	if ignoreWhitespace {
+		args = append(args, "--ignore-all-space")
+	}
+	cmd := exec.Command("git", args...)
 	var out bytes.Buffer
 	cmd.Stdout = &out
 	err := cmd.Run()
@@ -137,333 +499,5924 @@ func (gc *RealGitClient) GetStagedFiles() (string, error) {
 	return out.String(), nil
 }
 
-type ConsolePrinter struct{}
+// GetDiffAgainst returns the changes on HEAD since it forked from ref
+func (gc *RealGitClient) GetDiffAgainst(ref string) (string, error) {
+	cmd := exec.Command("git", "diff", ref+"...HEAD", "--")
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		if isUnknownRevision(stderr.String()) {
+			return "", fmt.Errorf("%w: %s", ErrUnknownRef, ref)
+		}
+		return "", fmt.Errorf("error running git diff against %s: %w", ref, err)
+	}
+	return out.String(), nil
+}
 
-func (p *ConsolePrinter) Print(msg string) {
-	fmt.Println(msg)
+// isUnknownRevision reports whether git's stderr says a ref doesn't exist
+func isUnknownRevision(stderr string) bool {
+	return strings.Contains(stderr, "unknown revision") || strings.Contains(stderr, "bad revision")
 }
 
-func (p *ConsolePrinter) PrintSuccess(msg string) {
-	fmt.Println(Green + msg + Reset)
+func (gc *RealGitClient) GetFilesAgainst(ref string) (string, error) {
+	cmd := exec.Command("git", "diff", "--name-only", ref+"...HEAD", "--")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("error getting files changed since %s: %w", ref, err)
+	}
+	return out.String(), nil
 }
 
-func (p *ConsolePrinter) PrintError(msg string) {
-	fmt.Println(Red + msg + Reset)
+// GetUntrackedFiles lists new files that aren't staged or ignored
+func (gc *RealGitClient) GetUntrackedFiles() ([]string, error) {
+	cmd := exec.Command("git", "ls-files", "--others", "--exclude-standard")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("error listing untracked files: %w", err)
+	}
+	var files []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
 }
 
-func (p *ConsolePrinter) PrintWarning(msg string) {
-	fmt.Println(Yellow + msg + Reset)
+func (gc *RealGitClient) GetStagedSummary() (string, error) {
+	cmd := exec.Command("git", "diff", "--staged", "--summary")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("error getting change summary: %w", err)
+	}
+	return out.String(), nil
 }
 
-// Services
-type ConfigService struct {
-	fs      FileSystem
-	printer Printer
+func (gc *RealGitClient) GetRepoRoot() (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--show-toplevel")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("error finding repository root: %w", err)
+	}
+	return strings.TrimSpace(out.String()), nil
 }
 
-func NewConfigService(fs FileSystem, printer Printer) *ConfigService {
-	return &ConfigService{fs: fs, printer: printer}
+// GetGitDir returns the repository's .git directory, which may be relative
+// to the working directory
+func (gc *RealGitClient) GetGitDir() (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--git-dir")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("error finding git directory: %w", err)
+	}
+	return strings.TrimSpace(out.String()), nil
 }
 
-func (cs *ConfigService) SaveConfig(apiKey, model string) error {
-	// Load existing config if it exists
-	existingConfig, _ := cs.LoadConfig()
+func (gc *RealGitClient) GetCommitSubject(sha string) (string, error) {
+	cmd := exec.Command("git", "log", "-1", "--format=%s", sha, "--")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("error reading commit %s: %w", sha, err)
+	}
+	return strings.TrimSpace(out.String()), nil
+}
 
-	// Start with existing config or create new one
-	config := Config{
-		ApiKey: "",
-		Model:  DefaultModel,
+func (gc *RealGitClient) GetCommitDiff(sha string) (string, error) {
+	cmd := exec.Command("git", "show", "--format=", sha, "--")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("error getting diff for commit %s: %w", sha, err)
 	}
+	return out.String(), nil
+}
 
-	if existingConfig != nil {
-		config = *existingConfig
+func (gc *RealGitClient) GetCommitRange(rangeSpec string) ([]string, error) {
+	cmd := exec.Command("git", "rev-list", "--reverse", rangeSpec, "--")
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		if isUnknownRevision(stderr.String()) {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownRef, rangeSpec)
+		}
+		return nil, fmt.Errorf("error listing commits in %s: %w", rangeSpec, err)
 	}
+	return strings.Fields(out.String()), nil
+}
 
-	// Update only the fields that were provided
-	if apiKey != "" {
-		config.ApiKey = apiKey
+func (gc *RealGitClient) GetUnpushedCommits() ([]string, error) {
+	cmd := exec.Command("git", "rev-list", "--reverse", "@{u}..HEAD")
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		if strings.Contains(stderr.String(), "no upstream") {
+			return nil, ErrNoUpstream
+		}
+		return nil, fmt.Errorf("error listing unpushed commits: %w", err)
+	}
+	return strings.Fields(out.String()), nil
+}
+
+func (gc *RealGitClient) StageAll() error {
+	cmd := exec.Command("git", "add", "-A")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("error staging changes: %w: %s", err, strings.TrimSpace(stderr.String()))
 	}
+	return nil
+}
 
-	if model != "" {
-		config.Model = model
+// StageTracked stages modified and deleted tracked files, like git commit -a
+func (gc *RealGitClient) StageTracked() error {
+	cmd := exec.Command("git", "add", "-u")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("error staging tracked changes: %w: %s", err, strings.TrimSpace(stderr.String()))
 	}
+	return nil
+}
 
-	// Validate that we have an API key (either from existing config or new input)
-	if config.ApiKey == "" {
-		return fmt.Errorf("API key is required. Use -api-key flag to set it")
+// commitArgs returns the git arguments Commit or, with amend, AmendCommit
+// runs. The message is passed on stdin with -F, so multi-line messages and
+// trailers reach git exactly as generated and no temp file is needed.
+func commitArgs(amend bool, opts CommitOptions) []string {
+	args := []string{"commit"}
+	if amend {
+		args = append(args, "--amend")
 	}
+	return append(append(args, "-F", "-"), opts.args()...)
+}
 
-	homeDir, err := cs.fs.UserHomeDir()
+func (gc *RealGitClient) Commit(message string, opts CommitOptions) error {
+	cmd := exec.Command("git", commitArgs(false, opts)...)
+	cmd.Stdin = strings.NewReader(message)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	err := cmd.Run()
 	if err != nil {
-		return fmt.Errorf("error getting home directory: %w", err)
+		// git reports "nothing to commit" on stdout, hook failures on stderr
+		detail := strings.TrimSpace(stderr.String())
+		if detail == "" {
+			detail = strings.TrimSpace(out.String())
+		}
+		return fmt.Errorf("error committing changes: %w: %s", err, detail)
+	}
+	return nil
+}
+
+func (gc *RealGitClient) GetLastCommitDiff() (string, error) {
+	if err := exec.Command("git", "rev-parse", "--verify", "--quiet", "HEAD").Run(); err != nil {
+		return "", ErrNoCommits
+	}
+
+	args := []string{"diff", "HEAD~1", "HEAD"}
+	if err := exec.Command("git", "rev-parse", "--verify", "--quiet", "HEAD~1").Run(); err != nil {
+		// The root commit has no parent to diff against
+		args = []string{"show", "--format=", "HEAD"}
 	}
 
-	configDir := filepath.Join(homeDir, ".claude-commit")
-	err = cs.fs.MkdirAll(configDir, 0755)
+	cmd := exec.Command("git", args...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Run()
 	if err != nil {
-		return fmt.Errorf("error creating config directory: %w", err)
+		return "", fmt.Errorf("error getting diff of last commit: %w", err)
 	}
+	return out.String(), nil
+}
 
-	configFile := filepath.Join(configDir, "config.json")
-	data, err := json.MarshalIndent(config, "", "  ")
+func (gc *RealGitClient) AmendCommit(message string, opts CommitOptions) error {
+	cmd := exec.Command("git", commitArgs(true, opts)...)
+	cmd.Stdin = strings.NewReader(message)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	err := cmd.Run()
 	if err != nil {
-		return fmt.Errorf("error marshaling config: %w", err)
+		detail := strings.TrimSpace(stderr.String())
+		if detail == "" {
+			detail = strings.TrimSpace(out.String())
+		}
+		return fmt.Errorf("error amending commit: %w: %s", err, detail)
 	}
+	return nil
+}
 
-	err = cs.fs.WriteFile(configFile, data, 0644)
+func (gc *RealGitClient) GetRecentCommits(n int) ([]string, error) {
+	cmd := exec.Command("git", "log", "--format=%s", "-n", strconv.Itoa(n))
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Run()
 	if err != nil {
-		return fmt.Errorf("error writing config file: %w", err)
+		return nil, fmt.Errorf("error reading recent commits: %w", err)
 	}
+	var subjects []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			subjects = append(subjects, line)
+		}
+	}
+	return subjects, nil
+}
 
-	cs.printer.PrintSuccess("Configuration saved successfully")
-	cs.printer.Print(Bold + "API Key: " + Reset + MaskAPIKey(config.ApiKey))
-	cs.printer.Print(Bold + "Model: " + Reset + config.Model)
+func (gc *RealGitClient) GetCurrentBranch() (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("error reading current branch: %w", err)
+	}
+	return strings.TrimSpace(out.String()), nil
+}
 
-	return nil
+// GetAuthorIdentity reads user.name and user.email from git config, and
+// returns ErrNoGitIdentity when either is missing
+func (gc *RealGitClient) GetAuthorIdentity() (string, string, error) {
+	var values []string
+	for _, key := range []string{"user.name", "user.email"} {
+		out, err := exec.Command("git", "config", key).Output()
+		value := strings.TrimSpace(string(out))
+		if err != nil || value == "" {
+			// git config exits 1 when the key is unset
+			return "", "", ErrNoGitIdentity
+		}
+		values = append(values, value)
+	}
+	return values[0], values[1], nil
 }
 
-func (cs *ConfigService) LoadConfig() (*Config, error) {
-	homeDir, err := cs.fs.UserHomeDir()
+type RealCommandRunner struct{}
+
+func (r *RealCommandRunner) Run(ctx context.Context, name string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("command timed out: %w", ctx.Err())
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// RealEditor opens a temp file in the user's editor
+type RealEditor struct{}
+
+// Edit writes initial to a temp file, waits for the editor to exit and
+// returns the file's new content
+func (e *RealEditor) Edit(initial string) (string, error) {
+	f, err := os.CreateTemp("", "claude-commit-*.txt")
+	if err != nil {
+		return "", fmt.Errorf("error creating temp file: %w", err)
+	}
+	path := f.Name()
+	defer os.Remove(path)
+
+	_, err = f.WriteString(initial)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("error writing temp file: %w", err)
+	}
+
+	// Through the shell so EDITOR can carry arguments, e.g. "code --wait"
+	editor := editorCommand()
+	name, args := shellCommand(editor + ` "` + path + `"`)
+	cmd := exec.Command(name, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("error running editor %q: %w", editor, err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading edited message: %w", err)
+	}
+	return string(data), nil
+}
+
+// RealClipboard copies through the platform's clipboard command
+type RealClipboard struct{}
+
+// Copy pipes text to the first clipboard command found, returning
+// ErrNoClipboard when there is none
+func (c *RealClipboard) Copy(text string) error {
+	name, args, err := clipboardCommand()
 	if err != nil {
-		return nil, fmt.Errorf("error getting home directory: %w", err)
+		return err
+	}
+
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(text)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("error running %s: %w: %s", name, err, msg)
+		}
+		return fmt.Errorf("error running %s: %w", name, err)
+	}
+	return nil
+}
+
+// clipboardCommand returns pbcopy on macOS, clip on Windows, and elsewhere
+// the first of wl-copy, xclip and xsel that is installed
+func clipboardCommand() (string, []string, error) {
+	var candidates [][]string
+	switch runtime.GOOS {
+	case "darwin":
+		candidates = [][]string{{"pbcopy"}}
+	case "windows":
+		candidates = [][]string{{"clip"}}
+	default:
+		candidates = [][]string{
+			{"wl-copy"},
+			{"xclip", "-selection", "clipboard"},
+			{"xsel", "--clipboard", "--input"},
+		}
+	}
+	for _, candidate := range candidates {
+		if _, err := exec.LookPath(candidate[0]); err == nil {
+			return candidate[0], candidate[1:], nil
+		}
+	}
+	return "", nil, ErrNoClipboard
+}
+
+// editorCommand returns $EDITOR, falling back to notepad on Windows and vi
+// elsewhere
+func editorCommand() string {
+	if editor := strings.TrimSpace(os.Getenv("EDITOR")); editor != "" {
+		return editor
+	}
+	if runtime.GOOS == "windows" {
+		return "notepad"
+	}
+	return "vi"
+}
+
+// shellCommand returns the name and arguments needed to run a command string
+// through the platform shell
+func shellCommand(command string) (string, []string) {
+	if runtime.GOOS == "windows" {
+		return "cmd", []string{"/C", command}
+	}
+	return "sh", []string{"-c", command}
+}
+
+// ConsolePrinter writes to out, and errors and warnings to errw, stripping
+// ANSI escape codes unless color is set
+type ConsolePrinter struct {
+	out   io.Writer
+	errw  io.Writer
+	color bool
+}
+
+// NewConsolePrinter returns a printer writing to out and errw, which
+// default to stdout and stderr when nil
+func NewConsolePrinter(out, errw io.Writer, color bool) *ConsolePrinter {
+	if out == nil {
+		out = os.Stdout
+	}
+	if errw == nil {
+		errw = os.Stderr
+	}
+	return &ConsolePrinter{out: out, errw: errw, color: color}
+}
+
+func (p *ConsolePrinter) Print(msg string) {
+	p.println(p.out, "", msg)
+}
+
+func (p *ConsolePrinter) PrintSuccess(msg string) {
+	p.println(p.out, Green, msg)
+}
+
+func (p *ConsolePrinter) PrintError(msg string) {
+	p.println(p.errw, Red, msg)
+}
+
+func (p *ConsolePrinter) PrintWarning(msg string) {
+	p.println(p.errw, Yellow, msg)
+}
+
+func (p *ConsolePrinter) PrintInline(msg string) {
+	if !p.color {
+		msg = stripANSI(msg)
+	}
+	fmt.Fprint(p.out, msg)
+}
+
+func (p *ConsolePrinter) println(w io.Writer, color, msg string) {
+	if !p.color {
+		fmt.Fprintln(w, stripANSI(msg))
+		return
+	}
+	if color != "" {
+		msg = color + msg + Reset
+	}
+	fmt.Fprintln(w, msg)
+}
+
+var ansiPattern = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// stripANSI removes ANSI color and style escape codes from s
+func stripANSI(s string) string {
+	return ansiPattern.ReplaceAllString(s, "")
+}
+
+// colorEnabled reports whether output should be colored: not when disabled
+// by flag, when NO_COLOR is set (to any value), or when stdout isn't a terminal
+func colorEnabled(noColorFlag bool) bool {
+	if noColorFlag {
+		return false
+	}
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// extractFlag removes a boolean global flag given as -name or --name from
+// args and reports whether it was present
+func extractFlag(args []string, name string) ([]string, bool) {
+	var rest []string
+	found := false
+	for _, arg := range args {
+		if arg == "-"+name || arg == "--"+name {
+			found = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return rest, found
+}
+
+// extractValueFlag removes a global flag that takes a value, given as
+// "--name value" or "--name=value", from args and returns its value
+func extractValueFlag(args []string, name string) ([]string, string, error) {
+	var rest []string
+	value := ""
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-"+name || arg == "--"+name {
+			if i+1 >= len(args) {
+				return nil, "", fmt.Errorf("flag --%s needs a value", name)
+			}
+			i++
+			value = args[i]
+			continue
+		}
+		if v, ok := strings.CutPrefix(arg, "--"+name+"="); ok {
+			value = v
+			continue
+		}
+		if v, ok := strings.CutPrefix(arg, "-"+name+"="); ok {
+			value = v
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return rest, value, nil
+}
+
+// Services
+type ConfigService struct {
+	fs      FileSystem
+	printer Printer
+	input   io.Reader
+	profile string
+	// configFile is the path from --config-file, used in place of the
+	// config directory and profiles
+	configFile string
+	secrets    SecretStore // nil keeps the API key in the config file
+	// gitClient finds the repository root for RepoConfigFile; nil skips
+	// the repo config
+	gitClient GitClient
+	getwd     func() (string, error)
+}
+
+func NewConfigService(fs FileSystem, printer Printer) *ConfigService {
+	return &ConfigService{fs: fs, printer: printer, input: os.Stdin, getwd: os.Getwd}
+}
+
+// SetProfile switches to the named profile; an empty name is the default
+// profile stored in config.json
+func (cs *ConfigService) SetProfile(name string) error {
+	if name != "" && !profileNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid profile name %q: use letters, digits, '-', '_' and '.'", name)
+	}
+	if name != "" && cs.configFile != "" {
+		return fmt.Errorf("-profile cannot be combined with --config-file")
+	}
+	cs.profile = name
+	return nil
+}
+
+// SetConfigFile makes path the only config file read and written, in place
+// of the default location. Its extension picks the format, as in
+// ConfigFileNames; anything else is read as JSON.
+func (cs *ConfigService) SetConfigFile(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("error resolving config file path: %w", err)
+	}
+	cs.configFile = abs
+	return nil
+}
+
+// ConfigDirEnv overrides the directory holding the config, profiles,
+// history and cache
+const ConfigDirEnv = "CLAUDE_COMMIT_CONFIG_DIR"
+
+// configDir returns the directory holding the config, profiles, history and
+// cache: $CLAUDE_COMMIT_CONFIG_DIR, then $XDG_CONFIG_HOME/claude-commit, then
+// ~/.claude-commit. An existing ~/.claude-commit is kept over an empty XDG
+// directory so that setting XDG_CONFIG_HOME doesn't lose the saved config.
+func configDir(fs FileSystem) (string, error) {
+	if dir := fs.Getenv(ConfigDirEnv); dir != "" {
+		return dir, nil
+	}
+
+	homeDir, err := fs.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error getting home directory: %w", err)
+	}
+	legacyDir := filepath.Join(homeDir, ".claude-commit")
+
+	xdgHome := fs.Getenv("XDG_CONFIG_HOME")
+	if xdgHome == "" {
+		return legacyDir, nil
+	}
+	xdgDir := filepath.Join(xdgHome, "claude-commit")
+	if entries, err := fs.ListDir(xdgDir); err == nil && len(entries) > 0 {
+		return xdgDir, nil
+	}
+	if entries, err := fs.ListDir(legacyDir); err == nil && len(entries) > 0 {
+		return legacyDir, nil
+	}
+	return xdgDir, nil
+}
+
+// configPaths returns the candidate config files of the active profile in
+// lookup order. The first is used when none exists yet.
+func (cs *ConfigService) configPaths() ([]string, error) {
+	if cs.configFile != "" {
+		return []string{cs.configFile}, nil
+	}
+
+	configDir, err := configDir(cs.fs)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, len(ConfigFileNames))
+	for i, name := range ConfigFileNames {
+		if cs.profile != "" {
+			paths[i] = filepath.Join(configDir, ProfilesDir, cs.profile+filepath.Ext(name))
+		} else {
+			paths[i] = filepath.Join(configDir, name)
+		}
+	}
+	return paths, nil
+}
+
+// ListProfiles prints the names of the saved profiles
+func (cs *ConfigService) ListProfiles() error {
+	dir, err := configDir(cs.fs)
+	if err != nil {
+		return err
+	}
+
+	entries, err := cs.fs.ListDir(filepath.Join(dir, ProfilesDir))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error listing profiles: %w", err)
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		ext := filepath.Ext(entry)
+		name := strings.TrimSuffix(entry, ext)
+		if !isConfigExt(ext) || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		cs.printer.Print("No profiles found. Create one with 'claude_commit config -profile <name> -api-key \"your-api-key\"'")
+		return nil
+	}
+
+	cs.printer.Print(Bold + Cyan + "Profiles:" + Reset)
+	for _, name := range names {
+		cs.printer.Print(name)
+	}
+	return nil
+}
+
+// SaveOptions holds the flags of the config command that aren't saved
+type SaveOptions struct {
+	AllowUnknownModel bool
+}
+
+func (cs *ConfigService) SaveConfig(update Config, opts SaveOptions) error {
+	// Load existing config if it exists
+	existingConfig, existingFile, _ := cs.loadConfigFile()
+
+	// Start with existing config or create new one
+	config := Config{
+		ApiKey: "",
+		Model:  DefaultModel,
+	}
+
+	if existingConfig != nil {
+		config = *existingConfig
+	}
+
+	// Update only the fields that were provided
+	if update.ApiKey != "" {
+		config.ApiKey = update.ApiKey
+	}
+
+	if update.Model != "" {
+		update.Model = resolveModel(update.Model)
+		if !opts.AllowUnknownModel {
+			if err := validateModel(update.Model); err != nil {
+				return err
+			}
+		}
+		config.Model = update.Model
+	}
+
+	if update.ContextCommand != "" {
+		config.ContextCommand = update.ContextCommand
+	}
+
+	if update.PromptTemplate != "" {
+		config.PromptTemplate = update.PromptTemplate
+	}
+
+	if update.MaxSubjectLength != 0 {
+		if update.MaxSubjectLength < 0 {
+			return fmt.Errorf("max subject length must be positive, got %d", update.MaxSubjectLength)
+		}
+		config.MaxSubjectLength = update.MaxSubjectLength
+	}
+
+	if update.MaxFiles != 0 {
+		if update.MaxFiles < 0 {
+			return fmt.Errorf("max files must be positive, got %d", update.MaxFiles)
+		}
+		config.MaxFiles = update.MaxFiles
+	}
+
+	if update.Temperature != 0 {
+		if err := validateSampling("temperature", update.Temperature); err != nil {
+			return err
+		}
+		config.Temperature = update.Temperature
+	}
+
+	if update.TopP != 0 {
+		if err := validateSampling("top-p", update.TopP); err != nil {
+			return err
+		}
+		config.TopP = update.TopP
+	}
+
+	if update.SubjectCase != "" {
+		if err := validateSubjectCase(update.SubjectCase); err != nil {
+			return err
+		}
+		config.SubjectCase = update.SubjectCase
+	}
+
+	if update.CommitPrefix != "" {
+		config.CommitPrefix = strings.TrimSpace(update.CommitPrefix)
+	}
+
+	if update.PrefixPosition != "" {
+		if err := validatePrefixPosition(update.PrefixPosition); err != nil {
+			return err
+		}
+		config.PrefixPosition = update.PrefixPosition
+	}
+
+	if update.UserAgent != "" {
+		if err := validateUserAgent(update.UserAgent); err != nil {
+			return err
+		}
+		config.UserAgent = update.UserAgent
+	}
+
+	if len(update.ExtraHeaders) > 0 {
+		if err := validateExtraHeaders(update.ExtraHeaders); err != nil {
+			return err
+		}
+		if config.ExtraHeaders == nil {
+			config.ExtraHeaders = make(map[string]string)
+		}
+		for name, value := range update.ExtraHeaders {
+			config.ExtraHeaders[name] = value
+		}
+	}
+
+	if len(update.CustomTypes) > 0 {
+		if err := validateCustomTypes(update.CustomTypes); err != nil {
+			return err
+		}
+		config.CustomTypes = update.CustomTypes
+	}
+
+	if update.Provider != "" {
+		if err := validateProvider(update.Provider); err != nil {
+			return err
+		}
+		config.Provider = update.Provider
+	}
+
+	if update.BaseURL != "" {
+		if err := validateBaseURL(update.BaseURL); err != nil {
+			return err
+		}
+		config.BaseURL = update.BaseURL
+	}
+
+	if update.APIVersion != "" {
+		if !apiVersionPattern.MatchString(update.APIVersion) {
+			cs.printer.PrintWarning(fmt.Sprintf("API version %q doesn't look like a date such as %s; saving it anyway", update.APIVersion, DefaultAPIVersion))
+		}
+		config.APIVersion = update.APIVersion
+	}
+
+	if update.HTTPTimeout != "" {
+		if err := validateDuration("HTTP timeout", update.HTTPTimeout); err != nil {
+			return err
+		}
+		config.HTTPTimeout = update.HTTPTimeout
+	}
+
+	if update.Language != "" {
+		if err := validateLanguage(update.Language); err != nil {
+			return err
+		}
+		config.Language = update.Language
+	}
+
+	if update.CacheTTL != "" {
+		if err := validateDuration("cache TTL", update.CacheTTL); err != nil {
+			return err
+		}
+		config.CacheTTL = update.CacheTTL
+	}
+
+	if update.TicketPattern != "" {
+		if err := validateTicketPattern(update.TicketPattern); err != nil {
+			return err
+		}
+		config.TicketPattern = update.TicketPattern
+	}
+
+	// Validate that we have an API key (either from existing config or new input)
+	if config.ApiKey == "" {
+		return fmt.Errorf("API key is required. Use -api-key flag to set it")
+	}
+	// Only a warning here, since new kinds of key may not match today's format
+	if update.ApiKey != "" && usesAnthropicKey(config) {
+		if err := validateAPIKeyFormat(config.ApiKey); err != nil {
+			cs.printer.PrintWarning("The API key looks malformed: " + err.Error())
+		}
+	}
+
+	paths, err := cs.configPaths()
+	if err != nil {
+		return err
+	}
+
+	err = cs.fs.MkdirAll(filepath.Dir(paths[0]), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating config directory: %w", err)
+	}
+
+	// Write back in the format of the existing file, defaulting to JSON
+	configFile := paths[0]
+	if existingFile != "" {
+		configFile = existingFile
+	}
+	fileConfig := config
+	inKeyring := cs.storeAPIKey(config.ApiKey)
+	if inKeyring {
+		fileConfig.ApiKey = ""
+	}
+	data, err := marshalConfig(configFile, fileConfig)
+	if err != nil {
+		return fmt.Errorf("error marshaling config: %w", err)
+	}
+
+	err = cs.fs.WriteFile(configFile, data, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing config file: %w", err)
+	}
+
+	cs.printer.PrintSuccess("Configuration saved successfully")
+	cs.printer.Print(Bold + "Config File: " + Reset + configFile)
+	if inKeyring {
+		cs.printer.Print(Bold + "API Key: " + Reset + MaskAPIKey(config.ApiKey) + " (stored in the OS keyring)")
+	} else {
+		cs.printer.Print(Bold + "API Key: " + Reset + MaskAPIKey(config.ApiKey))
+	}
+	cs.printer.Print(Bold + "Model: " + Reset + config.Model)
+	if config.ContextCommand != "" {
+		cs.printer.Print(Bold + "Context Command: " + Reset + config.ContextCommand)
+	}
+	if config.PromptTemplate != "" {
+		cs.printer.Print(Bold + "Prompt Template: " + Reset + config.PromptTemplate)
+	}
+	if config.UserAgent != "" {
+		cs.printer.Print(Bold + "User Agent: " + Reset + config.UserAgent)
+	}
+	if len(config.ExtraHeaders) > 0 {
+		// Only the names, since values are often credentials
+		cs.printer.Print(Bold + "Extra Headers: " + Reset + strings.Join(sortedKeys(config.ExtraHeaders), ", "))
+	}
+	if config.SubjectCase != "" {
+		cs.printer.Print(Bold + "Subject Case: " + Reset + config.SubjectCase)
+	}
+	if rules := describeRules(config.Rules); rules != "" {
+		cs.printer.Print(Bold + "Rules: " + Reset + rules)
+	}
+	if config.CommitPrefix != "" {
+		cs.printer.Print(Bold + "Commit Prefix: " + Reset + config.CommitPrefix + " (" + prefixPosition(config) + " the type)")
+	}
+	if config.MaxSubjectLength != 0 {
+		cs.printer.Print(Bold + "Max Subject Length: " + Reset + strconv.Itoa(config.MaxSubjectLength))
+	}
+	if config.MaxFiles != 0 {
+		cs.printer.Print(Bold + "Max Files: " + Reset + strconv.Itoa(config.MaxFiles))
+	}
+	if config.Temperature != 0 {
+		cs.printer.Print(Bold + "Temperature: " + Reset + strconv.FormatFloat(config.Temperature, 'g', -1, 64))
+	}
+	if config.TopP != 0 {
+		cs.printer.Print(Bold + "Top P: " + Reset + strconv.FormatFloat(config.TopP, 'g', -1, 64))
+	}
+	if config.Provider != "" {
+		cs.printer.Print(Bold + "Provider: " + Reset + config.Provider)
+	}
+	if config.BaseURL != "" {
+		cs.printer.Print(Bold + "Base URL: " + Reset + config.BaseURL)
+	}
+	if config.APIVersion != "" {
+		cs.printer.Print(Bold + "API Version: " + Reset + config.APIVersion)
+	}
+	if len(config.CustomTypes) > 0 {
+		cs.printer.Print(Bold + "Custom Types: " + Reset + strings.Join(config.CustomTypes, ", "))
+	}
+	if config.TicketPattern != "" {
+		cs.printer.Print(Bold + "Ticket Pattern: " + Reset + config.TicketPattern)
+	}
+	if config.CacheTTL != "" {
+		cs.printer.Print(Bold + "Cache TTL: " + Reset + config.CacheTTL)
+	}
+	if config.Language != "" {
+		cs.printer.Print(Bold + "Language: " + Reset + config.Language)
+	}
+	if config.HTTPTimeout != "" {
+		cs.printer.Print(Bold + "HTTP Timeout: " + Reset + config.HTTPTimeout)
+	}
+
+	return nil
+}
+
+// LoadConfig loads the active profile's config, with the nearest
+// RepoConfigFile merged over it
+func (cs *ConfigService) LoadConfig() (*Config, error) {
+	config, _, err := cs.loadConfigFile()
+	if err != nil && !errors.Is(err, ErrConfigNotFound) {
+		return nil, err
+	}
+
+	repoConfig, repoErr := cs.readRepoConfig()
+	if repoErr != nil {
+		return nil, repoErr
+	}
+	if repoConfig == nil {
+		return config, err
+	}
+
+	if config == nil {
+		// A repo file alone is enough if the API key is in the keyring
+		config = &Config{}
+		cs.lookupAPIKey(config)
+		if config.ApiKey == "" {
+			return nil, err
+		}
+	}
+	merged := mergeConfig(*config, *repoConfig)
+	return &merged, nil
+}
+
+// RepoConfigFile holds per-project settings, such as the model and custom
+// types, that are merged over the global config
+const RepoConfigFile = ".claude-commit.json"
+
+// readRepoConfig parses the nearest RepoConfigFile between the working
+// directory and the repository root. It returns nil outside a repository or
+// when there is no such file.
+func (cs *ConfigService) readRepoConfig() (*Config, error) {
+	if cs.gitClient == nil {
+		return nil, nil
+	}
+	root, err := cs.gitClient.GetRepoRoot()
+	if err != nil || root == "" {
+		return nil, nil
+	}
+
+	dir, err := cs.getwd()
+	if err != nil {
+		dir = root
+	}
+	if rel, err := filepath.Rel(root, dir); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		// Outside the tree, e.g. through a symlink, so only look at the root
+		dir = root
+	}
+
+	for {
+		path := filepath.Join(dir, RepoConfigFile)
+		data, err := cs.fs.ReadFile(path)
+		if err == nil {
+			var config Config
+			if err := json.Unmarshal(data, &config); err != nil {
+				return nil, fmt.Errorf("error parsing %s: %w", path, err)
+			}
+			if dropped := dropUntrustedFields(&config); len(dropped) > 0 {
+				cs.printer.PrintWarning(fmt.Sprintf("Ignoring %s in %s; set them with 'claude_commit config' instead", strings.Join(dropped, ", "), path))
+			}
+			config.Model = resolveModel(config.Model)
+			return &config, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("error reading %s: %w", path, err)
+		}
+
+		parent := filepath.Dir(dir)
+		if dir == root || parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+// dropUntrustedFields clears the settings a cloned repository mustn't
+// control, since they could send the API key elsewhere or run commands,
+// and returns their names
+func dropUntrustedFields(config *Config) []string {
+	var dropped []string
+	drop := func(name string, set bool) {
+		if set {
+			dropped = append(dropped, name)
+		}
+	}
+	drop("api_key", config.ApiKey != "")
+	drop("base_url", config.BaseURL != "")
+	drop("provider", config.Provider != "")
+	drop("context_command", config.ContextCommand != "")
+	drop("prompt_template", config.PromptTemplate != "")
+	drop("user_agent", config.UserAgent != "")
+	drop("extra_headers", len(config.ExtraHeaders) > 0)
+	config.ApiKey, config.BaseURL, config.Provider = "", "", ""
+	config.ContextCommand, config.PromptTemplate, config.UserAgent = "", "", ""
+	config.ExtraHeaders = nil
+	return dropped
+}
+
+// mergeConfig returns base with every field that is set in override
+// replaced by override's value
+func mergeConfig(base, override Config) Config {
+	merged := base
+	if override.ApiKey != "" {
+		merged.ApiKey = override.ApiKey
+	}
+	if override.Model != "" {
+		merged.Model = override.Model
+	}
+	if override.ContextCommand != "" {
+		merged.ContextCommand = override.ContextCommand
+	}
+	if override.PromptTemplate != "" {
+		merged.PromptTemplate = override.PromptTemplate
+	}
+	if override.AsciiOnly {
+		merged.AsciiOnly = true
+	}
+	if override.IgnoreWhitespace {
+		merged.IgnoreWhitespace = true
+	}
+	if override.Signoff {
+		merged.Signoff = true
+	}
+	if override.MaxLineLength != 0 {
+		merged.MaxLineLength = override.MaxLineLength
+	}
+	if override.UserAgent != "" {
+		merged.UserAgent = override.UserAgent
+	}
+	if len(override.ExtraHeaders) > 0 {
+		merged.ExtraHeaders = override.ExtraHeaders
+	}
+	if len(override.TemplatesByType) > 0 {
+		merged.TemplatesByType = override.TemplatesByType
+	}
+	if override.SubjectCase != "" {
+		merged.SubjectCase = override.SubjectCase
+	}
+	if override.Rules != nil {
+		merged.Rules = override.Rules
+	}
+	if override.CommitPrefix != "" {
+		merged.CommitPrefix = override.CommitPrefix
+	}
+	if override.PrefixPosition != "" {
+		merged.PrefixPosition = override.PrefixPosition
+	}
+	if override.BaseURL != "" {
+		merged.BaseURL = override.BaseURL
+	}
+	if override.APIVersion != "" {
+		merged.APIVersion = override.APIVersion
+	}
+	if len(override.CustomTypes) > 0 {
+		merged.CustomTypes = override.CustomTypes
+	}
+	if override.MaxSubjectLength != 0 {
+		merged.MaxSubjectLength = override.MaxSubjectLength
+	}
+	if override.MaxFiles != 0 {
+		merged.MaxFiles = override.MaxFiles
+	}
+	if override.Temperature != 0 {
+		merged.Temperature = override.Temperature
+	}
+	if override.TopP != 0 {
+		merged.TopP = override.TopP
+	}
+	if override.Provider != "" {
+		merged.Provider = override.Provider
+	}
+	if override.TicketPattern != "" {
+		merged.TicketPattern = override.TicketPattern
+	}
+	if override.CacheTTL != "" {
+		merged.CacheTTL = override.CacheTTL
+	}
+	if override.Language != "" {
+		merged.Language = override.Language
+	}
+	if override.HTTPTimeout != "" {
+		merged.HTTPTimeout = override.HTTPTimeout
+	}
+	return merged
+}
+
+// loadConfigFile loads the first config file found for the active profile
+// and returns it together with the path it was read from.
+func (cs *ConfigService) loadConfigFile() (*Config, string, error) {
+	config, configFile, err := cs.readConfigFile()
+	if err != nil {
+		return nil, "", err
+	}
+
+	cs.lookupAPIKey(config)
+	return config, configFile, nil
+}
+
+// lookupAPIKey fills in config's API key from the secret store when the
+// config file doesn't have one
+func (cs *ConfigService) lookupAPIKey(config *Config) {
+	if config.ApiKey != "" || cs.secrets == nil {
+		return
+	}
+	apiKey, err := cs.secrets.GetSecret(cs.apiKeySecret())
+	if err != nil && !errors.Is(err, ErrSecretNotFound) {
+		// Not fatal: commands that don't call the API still work
+		cs.printer.PrintWarning(fmt.Sprintf("Could not read the API key from the keyring: %v", err))
+	}
+	config.ApiKey = apiKey
+}
+
+// readConfigFile parses the first config file that exists, without looking
+// up the API key in the secret store
+func (cs *ConfigService) readConfigFile() (*Config, string, error) {
+	paths, err := cs.configPaths()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var readErr error
+	for _, configFile := range paths {
+		data, err := cs.fs.ReadFile(configFile)
+		if err != nil {
+			if readErr == nil {
+				readErr = err
+			}
+			continue
+		}
+
+		var config Config
+		err = unmarshalConfig(configFile, data, &config)
+		if err != nil {
+			return nil, "", fmt.Errorf("error parsing config file: %w", err)
+		}
+		return &config, configFile, nil
+	}
+
+	return nil, "", fmt.Errorf("%w: %w", ErrConfigNotFound, readErr)
+}
+
+// apiKeySecret is the secret store key holding the active profile's API key
+func (cs *ConfigService) apiKeySecret() string {
+	if cs.configFile != "" {
+		// Kept apart from the default key, so a config file used for
+		// testing can't replace it
+		return "api_key/file:" + cs.configFile
+	}
+	if cs.profile == "" {
+		return "api_key"
+	}
+	return "api_key/" + cs.profile
+}
+
+// storeAPIKey moves apiKey into the secret store, reporting whether it was
+// stored there. Without a usable store the key stays in the config file.
+func (cs *ConfigService) storeAPIKey(apiKey string) bool {
+	if cs.secrets == nil {
+		return false
+	}
+	if err := cs.secrets.SetSecret(cs.apiKeySecret(), apiKey); err != nil {
+		cs.printer.PrintWarning(fmt.Sprintf("Keyring unavailable, storing the API key in the config file: %v", err))
+		return false
+	}
+	return true
+}
+
+// ResetConfig deletes the saved configuration, asking first unless force is
+// set. A missing config file is not an error.
+func (cs *ConfigService) ResetConfig(force bool) error {
+	paths, err := cs.configPaths()
+	if err != nil {
+		return err
+	}
+
+	if !force {
+		cs.printer.Print(fmt.Sprintf("Delete the saved configuration in %s? [y/N]: ", filepath.Dir(paths[0])))
+		scanner := bufio.NewScanner(cs.input)
+		answer := ""
+		if scanner.Scan() {
+			answer = strings.ToLower(strings.TrimSpace(scanner.Text()))
+		}
+		if answer != "y" && answer != "yes" {
+			cs.printer.Print("Reset cancelled")
+			return nil
+		}
+	}
+
+	removed := false
+	for _, path := range paths {
+		err := cs.fs.Remove(path)
+		if err == nil {
+			removed = true
+			continue
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error removing config file: %w", err)
+		}
+	}
+
+	if cs.secrets != nil {
+		err := cs.secrets.DeleteSecret(cs.apiKeySecret())
+		if err == nil {
+			removed = true
+		} else if !errors.Is(err, ErrSecretNotFound) {
+			cs.printer.PrintWarning(fmt.Sprintf("Could not remove the API key from the keyring: %v", err))
+		}
+	}
+
+	if removed {
+		cs.printer.PrintSuccess("Configuration reset")
+	} else {
+		cs.printer.Print("No saved configuration to reset")
+	}
+	return nil
+}
+
+func (cs *ConfigService) ViewConfig() error {
+	config, err := cs.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	cs.printer.Print(Bold + Cyan + "Current Configuration:" + Reset)
+	if cs.profile != "" {
+		cs.printer.Print(Bold + "Profile: " + Reset + cs.profile)
+	}
+	if cs.configFile != "" {
+		cs.printer.Print(Bold + "Config File: " + Reset + cs.configFile)
+	}
+	cs.printer.Print(Bold + "API Key: " + Reset + MaskAPIKey(config.ApiKey))
+	cs.printer.Print(Bold + "Model: " + Reset + config.Model)
+	if config.ContextCommand != "" {
+		cs.printer.Print(Bold + "Context Command: " + Reset + config.ContextCommand)
+	}
+	if config.PromptTemplate != "" {
+		cs.printer.Print(Bold + "Prompt Template: " + Reset + config.PromptTemplate)
+	}
+	if config.UserAgent != "" {
+		cs.printer.Print(Bold + "User Agent: " + Reset + config.UserAgent)
+	}
+	if len(config.ExtraHeaders) > 0 {
+		// Only the names, since values are often credentials
+		cs.printer.Print(Bold + "Extra Headers: " + Reset + strings.Join(sortedKeys(config.ExtraHeaders), ", "))
+	}
+	if config.SubjectCase != "" {
+		cs.printer.Print(Bold + "Subject Case: " + Reset + config.SubjectCase)
+	}
+	if rules := describeRules(config.Rules); rules != "" {
+		cs.printer.Print(Bold + "Rules: " + Reset + rules)
+	}
+	if config.CommitPrefix != "" {
+		cs.printer.Print(Bold + "Commit Prefix: " + Reset + config.CommitPrefix + " (" + prefixPosition(*config) + " the type)")
+	}
+	if config.MaxSubjectLength != 0 {
+		cs.printer.Print(Bold + "Max Subject Length: " + Reset + strconv.Itoa(config.MaxSubjectLength))
+	}
+	if config.MaxFiles != 0 {
+		cs.printer.Print(Bold + "Max Files: " + Reset + strconv.Itoa(config.MaxFiles))
+	}
+	if config.Temperature != 0 {
+		cs.printer.Print(Bold + "Temperature: " + Reset + strconv.FormatFloat(config.Temperature, 'g', -1, 64))
+	}
+	if config.TopP != 0 {
+		cs.printer.Print(Bold + "Top P: " + Reset + strconv.FormatFloat(config.TopP, 'g', -1, 64))
+	}
+	if config.Provider != "" {
+		cs.printer.Print(Bold + "Provider: " + Reset + config.Provider)
+	}
+	if config.BaseURL != "" {
+		cs.printer.Print(Bold + "Base URL: " + Reset + config.BaseURL)
+	}
+	if config.APIVersion != "" {
+		cs.printer.Print(Bold + "API Version: " + Reset + config.APIVersion)
+	}
+	if len(config.CustomTypes) > 0 {
+		cs.printer.Print(Bold + "Custom Types: " + Reset + strings.Join(config.CustomTypes, ", "))
+	}
+	if config.TicketPattern != "" {
+		cs.printer.Print(Bold + "Ticket Pattern: " + Reset + config.TicketPattern)
+	}
+	if config.CacheTTL != "" {
+		cs.printer.Print(Bold + "Cache TTL: " + Reset + config.CacheTTL)
+	}
+	if config.Language != "" {
+		cs.printer.Print(Bold + "Language: " + Reset + config.Language)
+	}
+	if config.HTTPTimeout != "" {
+		cs.printer.Print(Bold + "HTTP Timeout: " + Reset + config.HTTPTimeout)
+	}
+
+	return nil
+}
+
+type ModelService struct {
+	configService    *ConfigService
+	anthropicService *AnthropicService
+	printer          Printer
+}
+
+func NewModelService(configService *ConfigService, anthropicService *AnthropicService, printer Printer) *ModelService {
+	return &ModelService{
+		configService:    configService,
+		anthropicService: anthropicService,
+		printer:          printer,
+	}
+}
+
+// HistoryFile is where generated messages are logged, under ~/.claude-commit
+const HistoryFile = "history.jsonl"
+
+// DefaultHistoryEntries is how many entries the history command shows
+const DefaultHistoryEntries = 10
+
+// HistoryEntry is one generated message in the history file
+type HistoryEntry struct {
+	Time    time.Time `json:"time"`
+	Model   string    `json:"model"`
+	Message string    `json:"message"`
+	Applied bool      `json:"applied"` // Committed or amended by the tool
+}
+
+type HistoryService struct {
+	fs      FileSystem
+	printer Printer
+}
+
+func NewHistoryService(fs FileSystem, printer Printer) *HistoryService {
+	return &HistoryService{
+		fs:      fs,
+		printer: printer,
+	}
+}
+
+// historyPath returns the path of the history file
+func (hs *HistoryService) historyPath() (string, error) {
+	dir, err := configDir(hs.fs)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, HistoryFile), nil
+}
+
+// Append adds entry as a new line of the history file, creating it if needed
+func (hs *HistoryService) Append(entry HistoryEntry) error {
+	path, err := hs.historyPath()
+	if err != nil {
+		return err
+	}
+
+	data, err := hs.fs.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error reading history file: %w", err)
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error marshaling history entry: %w", err)
+	}
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	data = append(append(data, line...), '\n')
+
+	if err := hs.fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating config directory: %w", err)
+	}
+	if err := hs.fs.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("error writing history file: %w", err)
+	}
+	return nil
+}
+
+// Recent returns up to n of the newest entries, oldest first. A missing
+// history file has no entries; unreadable lines are skipped.
+func (hs *HistoryService) Recent(n int) ([]HistoryEntry, error) {
+	path, err := hs.historyPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := hs.fs.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading history file: %w", err)
+	}
+
+	var entries []HistoryEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var entry HistoryEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if n > 0 && len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries, nil
+}
+
+// ShowHistory prints the last n generated messages
+func (hs *HistoryService) ShowHistory(n int) error {
+	entries, err := hs.Recent(n)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		hs.printer.Print("No message history yet")
+		return nil
+	}
+
+	for _, entry := range entries {
+		subject, _, _ := strings.Cut(entry.Message, "\n")
+		status := ""
+		if entry.Applied {
+			status = Green + " [applied]" + Reset
+		}
+		hs.printer.Print(Dim + entry.Time.Local().Format("2006-01-02 15:04") + "  " + entry.Model + Reset + status)
+		hs.printer.Print("  " + subject)
+	}
+	return nil
+}
+
+// CacheDir holds cached generations, one file per prompt, under ~/.claude-commit
+const CacheDir = "cache"
+
+// DefaultCacheTTL is how long a cached generation is reused
+const DefaultCacheTTL = 24 * time.Hour
+
+// CacheEntry is a cached generation: the raw candidates before post-processing
+type CacheEntry struct {
+	Created  time.Time `json:"created"`
+	Messages []string  `json:"messages"`
+}
+
+// CacheService stores generated messages keyed by a hash of the request so
+// regenerating for an unchanged diff doesn't call the API again
+type CacheService struct {
+	fs  FileSystem
+	now func() time.Time
+}
+
+func NewCacheService(fs FileSystem) *CacheService {
+	return &CacheService{fs: fs, now: time.Now}
+}
+
+// cacheKey hashes everything that shapes the model's reply
+func cacheKey(config Config, system, prompt string, n int) string {
+	h := sha256.New()
+	for _, part := range []string{config.Provider, config.BaseURL, config.Model, system, prompt, strconv.Itoa(n),
+		strconv.FormatFloat(config.Temperature, 'g', -1, 64), strconv.FormatFloat(config.TopP, 'g', -1, 64)} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cachePath returns the file for key
+func (c *CacheService) cachePath(key string) (string, error) {
+	dir, err := configDir(c.fs)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, CacheDir, key+".json"), nil
+}
+
+// Get returns the messages cached under key if they're younger than ttl.
+// Missing or unreadable entries are misses; expired ones are removed.
+func (c *CacheService) Get(key string, ttl time.Duration) ([]string, bool) {
+	path, err := c.cachePath(key)
+	if err != nil {
+		return nil, false
+	}
+	data, err := c.fs.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var entry CacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || len(entry.Messages) == 0 {
+		return nil, false
+	}
+	if c.now().Sub(entry.Created) >= ttl {
+		_ = c.fs.Remove(path)
+		return nil, false
+	}
+	return entry.Messages, true
+}
+
+// Put caches messages under key
+func (c *CacheService) Put(key string, messages []string) error {
+	path, err := c.cachePath(key)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(CacheEntry{Created: c.now(), Messages: messages})
+	if err != nil {
+		return fmt.Errorf("error marshaling cache entry: %w", err)
+	}
+	if err := c.fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating cache directory: %w", err)
+	}
+	if err := c.fs.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("error writing cache file: %w", err)
+	}
+	return nil
+}
+
+// cacheTTL returns the configured cache lifetime or the default
+func cacheTTL(config Config) time.Duration {
+	if ttl, err := time.ParseDuration(config.CacheTTL); err == nil && ttl > 0 {
+		return ttl
+	}
+	return DefaultCacheTTL
+}
+
+// validateDuration checks that value is a positive duration like "30m";
+// name describes the setting in the error
+func validateDuration(name, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, value, err)
+	}
+	if d <= 0 {
+		return fmt.Errorf("invalid %s %q: must be positive", name, value)
+	}
+	return nil
+}
+
+// HookName is the git hook installed by install-hook
+const HookName = "prepare-commit-msg"
+
+// hookMarker identifies hooks written by install-hook so they're never
+// mistaken for, or overwritten by, a user's own hook
+const hookMarker = "# Installed by claude_commit install-hook"
+
+// hookScript fills in the commit message file unless git already has a
+// message from -m, -F, a template, a merge or an amend
+const hookScript = `#!/bin/sh
+` + hookMarker + `
+case "$2" in
+  message|template|merge|squash|commit) exit 0 ;;
+esac
+claude_commit commit -write "$1" || exit 0
+`
+
+type HookService struct {
+	gitClient GitClient
+	fs        FileSystem
+	printer   Printer
+}
+
+func NewHookService(gitClient GitClient, fs FileSystem, printer Printer) *HookService {
+	return &HookService{
+		gitClient: gitClient,
+		fs:        fs,
+		printer:   printer,
+	}
+}
+
+// hookPath returns where the prepare-commit-msg hook lives in this repository
+func (hs *HookService) hookPath() (string, error) {
+	gitDir, err := hs.gitClient.GetGitDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(gitDir, "hooks", HookName), nil
+}
+
+// InstallHook writes the prepare-commit-msg hook. An existing hook that
+// wasn't installed by us is left alone unless force is set, in which case
+// it's moved to a .bak file first.
+func (hs *HookService) InstallHook(force bool) error {
+	path, err := hs.hookPath()
+	if err != nil {
+		return err
+	}
+	backup := path + ".bak"
+
+	existing, err := hs.fs.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error reading existing hook: %w", err)
+	}
+	if err == nil && !strings.Contains(string(existing), hookMarker) {
+		if !force {
+			return fmt.Errorf("a %s hook already exists at %s; rerun with -force to back it up to %s", HookName, path, backup)
+		}
+		if err := hs.fs.WriteFile(backup, existing, 0755); err != nil {
+			return fmt.Errorf("error backing up existing hook: %w", err)
+		}
+		hs.printer.PrintWarning("Existing hook backed up to " + backup)
+	}
+	if err == nil {
+		// Removing first means the new file is created with our permissions
+		if err := hs.fs.Remove(path); err != nil {
+			return fmt.Errorf("error replacing existing hook: %w", err)
+		}
+	}
+
+	if err := hs.fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating hooks directory: %w", err)
+	}
+	if err := hs.fs.WriteFile(path, []byte(hookScript), 0755); err != nil {
+		return fmt.Errorf("error writing hook: %w", err)
+	}
+
+	hs.printer.PrintSuccess("✓ Installed " + HookName + " hook at " + path)
+	return nil
+}
+
+// UninstallHook removes a hook written by InstallHook and restores any
+// backed up hook it replaced
+func (hs *HookService) UninstallHook() error {
+	path, err := hs.hookPath()
+	if err != nil {
+		return err
+	}
+
+	existing, err := hs.fs.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no %s hook installed at %s", HookName, path)
+	}
+	if err != nil {
+		return fmt.Errorf("error reading hook: %w", err)
+	}
+	if !strings.Contains(string(existing), hookMarker) {
+		return fmt.Errorf("the %s hook at %s wasn't installed by claude_commit; remove it by hand", HookName, path)
+	}
+	if err := hs.fs.Remove(path); err != nil {
+		return fmt.Errorf("error removing hook: %w", err)
+	}
+	hs.printer.PrintSuccess("✓ Removed " + HookName + " hook from " + path)
+
+	backup := path + ".bak"
+	original, err := hs.fs.ReadFile(backup)
+	if err != nil {
+		return nil
+	}
+	if err := hs.fs.WriteFile(path, original, 0755); err != nil {
+		return fmt.Errorf("error restoring backed up hook: %w", err)
+	}
+	if err := hs.fs.Remove(backup); err != nil {
+		return fmt.Errorf("error removing hook backup: %w", err)
+	}
+	hs.printer.PrintSuccess("✓ Restored previous hook from " + backup)
+	return nil
+}
+
+// ValidateConfig makes a minimal authenticated request to confirm the
+// configured API key and model work
+func (ms *ModelService) ValidateConfig() error {
+	config, err := ms.configService.LoadConfig()
+	if err != nil {
+		return err
+	}
+	// Validate only speaks the Anthropic API
+	if config.Provider != "" && config.Provider != ProviderAnthropic {
+		return fmt.Errorf("validate is only supported with the %s provider, not %q", ProviderAnthropic, config.Provider)
+	}
+
+	ctx, cancel := apiContext(DefaultAPITimeout)
+	defer cancel()
+
+	model, err := ms.anthropicService.Validate(ctx, *config)
+	if err != nil {
+		return err
+	}
+
+	ms.printer.PrintSuccess("✓ API key and model are valid")
+	resolved := model.ID
+	if model.DisplayName != "" {
+		resolved += " (" + model.DisplayName + ")"
+	}
+	ms.printer.Print(Bold + "Model: " + Reset + resolved)
+	return nil
+}
+
+// DoctorCommandTimeout bounds how long doctor waits for git --version
+const DoctorCommandTimeout = 10 * time.Second
+
+// DoctorService diagnoses setup problems: a missing git, running outside a
+// repository, a missing config or an API key the API rejects
+type DoctorService struct {
+	configService    *ConfigService
+	anthropicService *AnthropicService
+	gitClient        GitClient
+	runner           CommandRunner
+	printer          Printer
+}
+
+func NewDoctorService(configService *ConfigService, anthropicService *AnthropicService, gitClient GitClient, runner CommandRunner, printer Printer) *DoctorService {
+	return &DoctorService{
+		configService:    configService,
+		anthropicService: anthropicService,
+		gitClient:        gitClient,
+		runner:           runner,
+		printer:          printer,
+	}
+}
+
+// Run prints a pass or fail line for each check. Every check runs, even
+// after a failure, so one run shows everything that needs fixing.
+func (ds *DoctorService) Run() error {
+	config, configErr := ds.checkConfig()
+	results := []error{
+		ds.report("git installed", ds.checkGit()),
+		ds.report("git repository", ds.checkRepo()),
+		ds.report("config", configErr),
+	}
+	if configErr != nil {
+		ds.printer.PrintWarning("- API key: not checked without a config")
+	} else {
+		results = append(results, ds.report("API key", ds.checkAPIKey(*config)))
+	}
+
+	failed := 0
+	for _, err := range results {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(results))
+	}
+	ds.printer.PrintSuccess("All checks passed")
+	return nil
+}
+
+// report prints the result of one check and returns its error
+func (ds *DoctorService) report(name string, err error) error {
+	if err != nil {
+		ds.printer.PrintError(fmt.Sprintf("✗ %s: %v", name, err))
+	} else {
+		ds.printer.PrintSuccess("✓ " + name)
+	}
+	return err
+}
+
+// checkGit runs git --version to find git on the PATH
+func (ds *DoctorService) checkGit() error {
+	ctx, cancel := context.WithTimeout(context.Background(), DoctorCommandTimeout)
+	defer cancel()
+
+	if _, err := ds.runner.Run(ctx, "git", "--version"); err != nil {
+		return fmt.Errorf("git isn't on your PATH or won't run: %w", err)
+	}
+	return nil
+}
+
+// checkRepo checks that the working directory is inside a git repository
+func (ds *DoctorService) checkRepo() error {
+	root, err := ds.gitClient.GetRepoRoot()
+	if err != nil || root == "" {
+		return fmt.Errorf("the current directory isn't inside a git repository")
+	}
+	return nil
+}
+
+// checkConfig loads the config and checks that it has an API key
+func (ds *DoctorService) checkConfig() (*Config, error) {
+	config, err := ds.configService.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config.ApiKey == "" {
+		return nil, fmt.Errorf("no API key configured")
+	}
+	return config, nil
+}
+
+// checkAPIKey validates config's key and model against the API. A
+// malformed key fails without a request.
+func (ds *DoctorService) checkAPIKey(config Config) error {
+	if !usesAnthropicKey(config) {
+		// Validate only speaks the Anthropic API
+		return nil
+	}
+	if err := validateAPIKeyFormat(config.ApiKey); err != nil {
+		return err
+	}
+
+	ctx, cancel := apiContext(DefaultAPITimeout)
+	defer cancel()
+
+	_, err := ds.anthropicService.Validate(ctx, config)
+	return err
+}
+
+var AvailableModels = []string{
+	"claude-opus-4-0",
+	"claude-sonnet-4-0",
+	"claude-3-7-sonnet-latest",
+	"claude-3-5-sonnet-latest",
+	"claude-3-5-haiku-latest",
+	"claude-3-opus-latest",
+}
+
+const DefaultModel = "claude-3-7-sonnet-latest"
+
+// ModelAliases are short names accepted wherever a model id is configured
+var ModelAliases = map[string]string{
+	"opus":       "claude-opus-4-0",
+	"sonnet":     "claude-sonnet-4-0",
+	"haiku":      "claude-3-5-haiku-latest",
+	"sonnet-3.7": "claude-3-7-sonnet-latest",
+	"sonnet-3.5": "claude-3-5-sonnet-latest",
+	"opus-3":     "claude-3-opus-latest",
+}
+
+// resolveModel returns the model id for an alias (case-insensitive) and any
+// other input unchanged, so full ids keep working
+func resolveModel(input string) string {
+	if model, ok := ModelAliases[strings.ToLower(strings.TrimSpace(input))]; ok {
+		return model
+	}
+	return input
+}
+
+// modelAliases returns the aliases of model, sorted
+func modelAliases(model string) []string {
+	var aliases []string
+	for alias, target := range ModelAliases {
+		if target == model {
+			aliases = append(aliases, alias)
+		}
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+// validateModel checks that model is one of AvailableModels (case-sensitive)
+func validateModel(model string) error {
+	for _, available := range AvailableModels {
+		if model == available {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown model %q. Valid options: %s (pass -allow-unknown-model to use it anyway)", model, strings.Join(AvailableModels, ", "))
+}
+
+// ShowModels lists the known models, or with refresh the models the API
+// currently offers, marking the configured and default ones
+func (ms *ModelService) ShowModels(refresh bool, format string) error {
+	config, err := ms.configService.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	models := AvailableModels
+	if refresh {
+		ctx, cancel := apiContext(DefaultAPITimeout)
+		defer cancel()
+
+		var live []string
+		if config.Provider != "" && config.Provider != ProviderAnthropic {
+			// ListModels only speaks the Anthropic API
+			err = fmt.Errorf("-refresh is only supported with the %s provider, not %q", ProviderAnthropic, config.Provider)
+		} else {
+			live, err = ms.anthropicService.ListModels(ctx, *config)
+		}
+		if err != nil && format == OutputJSON {
+			// A warning would end up mixed into the JSON, so fail instead
+			return fmt.Errorf("error fetching models: %w", err)
+		} else if err != nil {
+			ms.printer.PrintWarning(fmt.Sprintf("Could not fetch models from the API, showing the built-in list: %v", err))
+		} else {
+			models = live
+		}
+	}
+
+	if format == OutputJSON {
+		return ms.printModelsJSON(models, config.Model)
+	}
+
+	ms.printer.Print(Bold + Cyan + "Available Models:" + Reset)
+	for _, model := range models {
+		aliases := ""
+		if names := modelAliases(model); len(names) > 0 {
+			aliases = Dim + " (" + strings.Join(names, ", ") + ")" + Reset
+		}
+		switch model {
+		case config.Model:
+			ms.printer.Print(Bold + Green + model + " [CURRENT]" + Reset + aliases)
+		case DefaultModel:
+			ms.printer.Print(Bold + model + " [DEFAULT]" + Reset + aliases)
+		default:
+			ms.printer.Print(Bold + model + Reset + aliases)
+		}
+	}
+
+	return nil
+}
+
+// ModelOutput is one entry of the models -json listing
+type ModelOutput struct {
+	ID      string `json:"id"`
+	Current bool   `json:"current"`
+	Default bool   `json:"default"`
+}
+
+// printModelsJSON prints models as a JSON array, flagging the configured
+// model and DefaultModel the way the human output marks them
+func (ms *ModelService) printModelsJSON(models []string, current string) error {
+	output := make([]ModelOutput, 0, len(models))
+	for _, model := range models {
+		output = append(output, ModelOutput{ID: model, Current: model == current, Default: model == DefaultModel})
+	}
+	data, err := json.Marshal(output)
+	if err != nil {
+		return fmt.Errorf("error encoding JSON output: %w", err)
+	}
+	ms.printer.Print(string(data))
+	return nil
+}
+
+// DefaultMaxResponseBytes caps how much of an API response body is read
+const DefaultMaxResponseBytes = 4 << 20
+
+// MessageMaxTokens caps the reply for one commit message, leaving room for a
+// footer such as BREAKING CHANGE
+const MessageMaxTokens = 150
+
+// BodyMaxTokens caps the reply for a message with a bulleted body (-body)
+const BodyMaxTokens = 600
+
+// DefaultBodyWrap is the column -body messages are wrapped at, per git
+// convention
+const DefaultBodyWrap = 72
+
+// DefaultMaxRetries is how many times a transient API failure is retried
+const DefaultMaxRetries = 2
+
+// RetryBaseDelay is the first backoff delay; each further retry doubles it
+const RetryBaseDelay = time.Second
+
+// StatusOverloaded is the non-standard status Anthropic returns when overloaded
+const StatusOverloaded = 529
+
+type AnthropicService struct {
+	client           HTTPClient
+	printer          Printer
+	verbose          bool
+	maxResponseBytes int64
+	maxRetries       int
+	stream           bool // Stream responses, printing text as it arrives
+	sleep            func(ctx context.Context, d time.Duration) error
+	now              func() time.Time
+}
+
+func NewAnthropicService(client HTTPClient, printer Printer) *AnthropicService {
+	return &AnthropicService{
+		client:           client,
+		printer:          printer,
+		maxResponseBytes: DefaultMaxResponseBytes,
+		maxRetries:       DefaultMaxRetries,
+		sleep:            sleepContext,
+		now:              time.Now,
+	}
+}
+
+// SetVerbose enables logging of request and response handling details
+func (as *AnthropicService) SetVerbose(verbose bool) {
+	as.verbose = verbose
+}
+
+// SetMaxRetries sets how many times a transient API failure is retried
+func (as *AnthropicService) SetMaxRetries(retries int) {
+	as.maxRetries = retries
+}
+
+// SetStream turns on streaming, printing the reply as it's generated
+func (as *AnthropicService) SetStream(stream bool) {
+	as.stream = stream
+}
+
+// generateCandidates asks gen for n alternative messages in one request
+func generateCandidates(ctx context.Context, gen CommitGenerator, config Config, system, prompt string, n, maxTokens int) ([]string, error) {
+	if n <= 1 {
+		msg, err := gen.Generate(ctx, config, system, prompt, maxTokens)
+		if err != nil {
+			return nil, err
+		}
+		return []string{msg}, nil
+	}
+
+	prompt += fmt.Sprintf("\n\nInstead of a single message, return exactly %d alternative commit messages as a numbered list, one per line, with no other text.", n)
+	text, err := gen.Generate(ctx, config, system, prompt, maxTokens*n)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := parseCandidateList(text)
+	if len(candidates) < n {
+		return nil, fmt.Errorf("expected %d commit messages from API, got %d", n, len(candidates))
+	}
+	return candidates[:n], nil
+}
+
+// candidatePrefixPattern matches list markers like "1.", "2)", "-", "*" or "•"
+var candidatePrefixPattern = regexp.MustCompile(`^(?:\d+[.)]|[-*•])\s+`)
+
+// parseCandidateList splits a numbered or bulleted list into its items,
+// ignoring blank lines and markdown code fences
+func parseCandidateList(text string) []string {
+	var candidates []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "```") {
+			continue
+		}
+		line = strings.TrimSpace(candidatePrefixPattern.ReplaceAllString(line, ""))
+		line = strings.Trim(line, "`")
+		if line != "" {
+			candidates = append(candidates, line)
+		}
+	}
+	return candidates
+}
+
+// Generate posts prompt to the Messages API, with system as the top-level
+// system prompt, and returns the parsed reply
+func (as *AnthropicService) Generate(ctx context.Context, config Config, system, prompt string, maxTokens int) (string, error) {
+	return as.GenerateConversation(ctx, config, system, buildConversation(prompt, nil), maxTokens)
+}
+
+// GenerateConversation is Generate for a whole conversation, such as one
+// built by buildConversation, and returns the next assistant reply
+func (as *AnthropicService) GenerateConversation(ctx context.Context, config Config, system string, messages []Message, maxTokens int) (string, error) {
+	requestBody := AnthropicRequest{
+		Model:       config.Model,
+		System:      system,
+		Messages:    messages,
+		MaxTokens:   maxTokens,
+		Temperature: config.Temperature,
+		TopP:        config.TopP,
+		Stream:      as.stream,
+	}
+
+	jsonBody, err := json.Marshal(requestBody)
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %w", err)
+	}
+
+	var resp *http.Response
+	var body []byte
+	var truncated bool
+	for attempt := 0; ; attempt++ {
+		if as.stream {
+			resp, err = as.send(ctx, config, "POST", MessagesPath, jsonBody)
+			if err == nil && resp.StatusCode == http.StatusOK {
+				return as.readStream(resp)
+			}
+			if err == nil {
+				// Errors come back as a plain JSON body, even when streaming
+				body, truncated, err = as.readResponse(resp)
+			}
+		} else {
+			resp, body, truncated, err = as.do(ctx, config, "POST", MessagesPath, jsonBody)
+		}
+		if err == nil && resp.StatusCode == http.StatusOK && !truncated && incompleteJSON(body) {
+			err = ErrAPIIncomplete
+		}
+		if errors.Is(err, ErrAPIIncomplete) && attempt < as.maxRetries {
+			delay := retryDelay(attempt, "", as.now())
+			if as.verbose {
+				as.printer.Print(Dim + fmt.Sprintf("API response was incomplete, retrying in %v (attempt %d of %d)", delay, attempt+2, as.maxRetries+1) + Reset)
+			}
+			if err := as.sleep(ctx, delay); err != nil {
+				return "", fmt.Errorf("%w: %w", ErrAPITimeout, err)
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if !retryableStatus(resp.StatusCode) || attempt >= as.maxRetries {
+			break
+		}
+
+		delay := retryDelay(attempt, resp.Header.Get("Retry-After"), as.now())
+		if as.verbose {
+			as.printer.Print(Dim + fmt.Sprintf("API returned status %d, retrying in %v (attempt %d of %d)", resp.StatusCode, delay, attempt+2, as.maxRetries+1) + Reset)
+		}
+		if err := as.sleep(ctx, delay); err != nil {
+			return "", fmt.Errorf("%w: %w", ErrAPITimeout, err)
+		}
+	}
+
+	if err := as.checkResponse(resp, body, truncated); err != nil {
+		return "", err
+	}
+
+	var anthropicResp AnthropicResponse
+	err = json.Unmarshal(body, &anthropicResp)
+	if err != nil {
+		// Complete but not valid JSON, so retrying won't help
+		return "", fmt.Errorf("error parsing API response: %w", err)
+	}
+
+	for _, parser := range responseParsers {
+		msg, ok := parser.parse(anthropicResp)
+		if !ok {
+			continue
+		}
+		if as.verbose {
+			as.printer.Print(Dim + "Parsed response using " + parser.name + " parser" + Reset)
+		}
+		return msg, nil
+	}
+
+	return "", fmt.Errorf("empty response from API")
+}
+
+// RefineTurn is one round of -refine: the message the model gave and the
+// instruction the user answered it with, e.g. "make it shorter"
+type RefineTurn struct {
+	Reply       string
+	Instruction string
+}
+
+// buildConversation returns the messages for prompt followed by each
+// refinement round, alternating user, assistant, user as the API requires
+func buildConversation(prompt string, turns []RefineTurn) []Message {
+	messages := []Message{{Role: AnthropicRoleUser, Content: prompt}}
+	for _, turn := range turns {
+		messages = append(messages,
+			Message{Role: AnthropicRoleAssistant, Content: turn.Reply},
+			Message{Role: AnthropicRoleUser, Content: turn.Instruction},
+		)
+	}
+	return messages
+}
+
+// ListModels fetches the IDs of the models the API currently offers
+func (as *AnthropicService) ListModels(ctx context.Context, config Config) ([]string, error) {
+	resp, body, truncated, err := as.do(ctx, config, "GET", ModelsPath+"?limit=1000", nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := as.checkResponse(resp, body, truncated); err != nil {
+		return nil, err
+	}
+
+	var modelsResp ModelsResponse
+	if err := json.Unmarshal(body, &modelsResp); err != nil {
+		return nil, fmt.Errorf("error parsing models response: %w", err)
+	}
+
+	var models []string
+	for _, model := range modelsResp.Data {
+		if model.ID != "" {
+			models = append(models, model.ID)
+		}
+	}
+	if len(models) == 0 {
+		return nil, fmt.Errorf("no models in API response")
+	}
+	return models, nil
+}
+
+// Validate checks that the API accepts config's key and model by looking
+// the model up, returning the model the API resolved it to
+func (as *AnthropicService) Validate(ctx context.Context, config Config) (*ModelInfo, error) {
+	if config.ApiKey == "" {
+		return nil, fmt.Errorf("no API key configured")
+	}
+
+	resp, body, truncated, err := as.do(ctx, config, "GET", ModelsPath+"/"+url.PathEscape(config.Model), nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("model %q is not available to this API key", config.Model)
+	}
+	if err := as.checkResponse(resp, body, truncated); err != nil {
+		return nil, err
+	}
+
+	var model ModelInfo
+	if err := json.Unmarshal(body, &model); err != nil {
+		return nil, fmt.Errorf("error parsing model response: %w", err)
+	}
+	return &model, nil
+}
+
+// checkResponse turns a non-200 or oversized response into an error
+func (as *AnthropicService) checkResponse(resp *http.Response, body []byte, truncated bool) error {
+	if resp.StatusCode != http.StatusOK {
+		if truncated && parseAPIError(providerNames[ProviderAnthropic], resp.StatusCode, body) == nil {
+			body = append(body, "... (truncated)"...)
+		}
+		return apiStatusError(providerNames[ProviderAnthropic], resp.StatusCode, body)
+	}
+
+	if truncated {
+		return fmt.Errorf("API response exceeds %d bytes", as.maxResponseBytes)
+	}
+	return nil
+}
+
+// APIErrorResponse is the JSON body the API returns with a failed request
+type APIErrorResponse struct {
+	Type  string `json:"type"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// APIError is a failed request decoded from an APIErrorResponse
+type APIError struct {
+	Provider   string // Display name, e.g. Anthropic or OpenAI
+	StatusCode int
+	Type       string // e.g. authentication_error or rate_limit_error
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s API error (%s): %s", e.Provider, e.Type, e.Message)
+}
+
+// Is matches ErrAPIAuth for authentication and permission errors, and
+// ErrAPIRate for rate limits, so they get the same suggestion as a bare
+// 401, 403 or 429
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrAPIAuth:
+		return e.Type == "authentication_error" || e.Type == "permission_error" ||
+			e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrAPIRate:
+		return e.Type == "rate_limit_error" || e.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// apiStatusError describes a failed response from provider's API, coded by
+// its cause
+func apiStatusError(provider string, statusCode int, body []byte) error {
+	if apiErr := parseAPIError(provider, statusCode, body); apiErr != nil {
+		code := CodeAPIError
+		if errors.Is(apiErr, ErrAPIAuth) {
+			code = CodeAPIAuth
+		} else if errors.Is(apiErr, ErrAPIRate) {
+			code = CodeAPIRate
+		}
+		return &CommitError{Code: code, Err: apiErr}
+	}
+
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("API error (status %d): %w: %s", statusCode, ErrAPIAuth, body)
+	case http.StatusTooManyRequests:
+		return fmt.Errorf("API error (status %d): %w: %s", statusCode, ErrAPIRate, body)
+	}
+	return &CommitError{Code: CodeAPIError, Err: fmt.Errorf("API error (status %d): %s", statusCode, body)}
+}
+
+// parseAPIError decodes a structured error body, returning nil when body
+// isn't one so the caller can fall back to the raw text
+func parseAPIError(provider string, statusCode int, body []byte) *APIError {
+	var resp APIErrorResponse
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Error.Type == "" {
+		return nil
+	}
+	return &APIError{Provider: provider, StatusCode: statusCode, Type: resp.Error.Type, Message: resp.Error.Message}
+}
+
+// do sends one request to the API endpoint at path and reads the
+// (size-limited) response body, closing it before returning
+func (as *AnthropicService) do(ctx context.Context, config Config, method, path string, jsonBody []byte) (*http.Response, []byte, bool, error) {
+	resp, err := as.send(ctx, config, method, path, jsonBody)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	body, truncated, err := as.readResponse(resp)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return resp, body, truncated, nil
+}
+
+// send makes one request to the API endpoint at path, returning the
+// response with its body still open
+func (as *AnthropicService) send(ctx context.Context, config Config, method, path string, jsonBody []byte) (*http.Response, error) {
+	var reqBody io.Reader
+	if jsonBody != nil {
+		reqBody = bytes.NewReader(jsonBody)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, apiURL(config, path), reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	if jsonBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("x-api-key", config.ApiKey)
+	req.Header.Set("anthropic-version", apiVersion(config))
+	req.Header.Set("User-Agent", userAgent(config))
+	setExtraHeaders(req, config)
+
+	if as.verbose {
+		as.logRequest(req, jsonBody)
+	}
+
+	resp, err := as.client.Do(req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w: %w", ErrAPITimeout, err)
+		}
+		return nil, fmt.Errorf("error making API call: %w", err)
+	}
+	return resp, nil
+}
+
+// readResponse reads the (size-limited) body of resp and closes it
+func (as *AnthropicService) readResponse(resp *http.Response) ([]byte, bool, error) {
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			as.printer.PrintError(fmt.Sprintf("Error closing response body: %v", err))
+		}
+	}()
+
+	body, truncated, err := readLimited(resp.Body, as.maxResponseBytes)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, false, fmt.Errorf("%w: %w", ErrAPITimeout, err)
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// The connection dropped partway through the body
+			return nil, false, fmt.Errorf("%w: %w", ErrAPIIncomplete, err)
+		}
+		return nil, false, fmt.Errorf("error reading API response: %w", err)
+	}
+	if as.verbose {
+		as.printer.Print(Dim + fmt.Sprintf("← %d %s", resp.StatusCode, http.StatusText(resp.StatusCode)) + Reset)
+		as.printer.Print(Dim + truncateLines(string(body), VerboseMaxLines) + Reset)
+	}
+	return body, truncated, nil
+}
+
+// StreamEvent is the data of one server-sent event from a streaming
+// Messages API response
+type StreamEvent struct {
+	Type  string `json:"type"`
+	Delta struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"delta"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// readStream prints the text of a streaming response as it arrives and
+// returns all of it once the message is complete, closing the body
+func (as *AnthropicService) readStream(resp *http.Response) (string, error) {
+	defer resp.Body.Close()
+	if as.verbose {
+		as.printer.Print(Dim + fmt.Sprintf("← %d %s (streaming)", resp.StatusCode, http.StatusText(resp.StatusCode)) + Reset)
+	}
+
+	text, err := parseStream(io.LimitReader(resp.Body, as.maxResponseBytes), as.printer.PrintInline)
+	if text != "" {
+		// End the line the streamed text left open
+		as.printer.Print("")
+	}
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return "", fmt.Errorf("%w: %w", ErrAPITimeout, err)
+		}
+		return "", err
+	}
+
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", fmt.Errorf("empty response from API")
+	}
+	return text, nil
+}
+
+// parseStream reads server-sent events, passing the text of each
+// content_block_delta to onDelta, until message_stop. It returns the text
+// so far, along with an error if the stream fails or ends early.
+func parseStream(r io.Reader, onDelta func(string)) (string, error) {
+	var text strings.Builder
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// Only data lines matter; each carries its event type in the JSON
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+
+		var event StreamEvent
+		if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &event); err != nil {
+			return text.String(), fmt.Errorf("error parsing stream event: %w", err)
+		}
+		switch event.Type {
+		case "content_block_delta":
+			if event.Delta.Type == "text_delta" && event.Delta.Text != "" {
+				text.WriteString(event.Delta.Text)
+				onDelta(event.Delta.Text)
+			}
+		case "message_stop":
+			return text.String(), nil
+		case "error":
+			apiErr := &APIError{Provider: providerNames[ProviderAnthropic], Type: event.Error.Type, Message: event.Error.Message}
+			code := CodeAPIError
+			if errors.Is(apiErr, ErrAPIRate) {
+				code = CodeAPIRate
+			}
+			return text.String(), &CommitError{Code: code, Err: apiErr}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return text.String(), fmt.Errorf("error reading API stream: %w", err)
+	}
+	return text.String(), fmt.Errorf("API stream ended before the message was complete")
+}
+
+// VerboseMaxLines is how much of a prompt or response body verbose logging shows
+const VerboseMaxLines = 40
+
+// logRequest prints the outgoing request with the API key masked and the
+// prompt cut to VerboseMaxLines, since it carries the whole diff
+func (as *AnthropicService) logRequest(req *http.Request, jsonBody []byte) {
+	as.printer.Print(Dim + fmt.Sprintf("→ %s %s", req.Method, req.URL) + Reset)
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if name == http.CanonicalHeaderKey("x-api-key") || name == "Authorization" {
+			value = MaskAPIKey(value)
+		}
+		as.printer.Print(Dim + fmt.Sprintf("  %s: %s", name, value) + Reset)
+	}
+
+	var logged AnthropicRequest
+	if jsonBody == nil || json.Unmarshal(jsonBody, &logged) != nil {
+		return
+	}
+	as.printer.Print(Dim + fmt.Sprintf("  Model: %s, max tokens: %d", logged.Model, logged.MaxTokens) + Reset)
+	if logged.System != "" {
+		as.printer.Print(Dim + fmt.Sprintf("  [system]\n%s", truncateLines(logged.System, VerboseMaxLines)) + Reset)
+	}
+	for _, msg := range logged.Messages {
+		as.printer.Print(Dim + fmt.Sprintf("  [%s]\n%s", msg.Role, truncateLines(msg.Content, VerboseMaxLines)) + Reset)
+	}
+}
+
+// truncateLines keeps the first n lines of s, noting how many were dropped
+func truncateLines(s string, n int) string {
+	lines := strings.Split(s, "\n")
+	if len(lines) <= n {
+		return s
+	}
+	return strings.Join(lines[:n], "\n") + fmt.Sprintf("\n... (%d more lines)", len(lines)-n)
+}
+
+// retryableStatus reports whether a response status is worth retrying:
+// rate limiting, overload and transient server errors
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, StatusOverloaded:
+		return true
+	}
+	return false
+}
+
+// retryDelay returns how long to wait before retry number attempt+1. A
+// Retry-After header (in seconds or as an HTTP date) takes precedence over
+// exponential backoff from RetryBaseDelay.
+func retryDelay(attempt int, retryAfter string, now time.Time) time.Duration {
+	if retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		if at, err := http.ParseTime(retryAfter); err == nil {
+			if delay := at.Sub(now); delay > 0 {
+				return delay
+			}
+			return 0
+		}
+	}
+	return RetryBaseDelay << attempt
+}
+
+// sleepContext waits for d, returning early with the context's error if it
+// is cancelled first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// readLimited reads at most limit bytes from r and reports whether there was
+// more data beyond the limit
+func readLimited(r io.Reader, limit int64) ([]byte, bool, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(data)) > limit {
+		return data[:limit], true, nil
+	}
+	return data, false, nil
+}
+
+// incompleteJSON reports whether body is empty or valid JSON cut off before
+// its end, as when a connection drops. Malformed JSON is not incomplete.
+func incompleteJSON(body []byte) bool {
+	var value json.RawMessage
+	err := json.NewDecoder(bytes.NewReader(body)).Decode(&value)
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// responseParser extracts the commit message from one shape of response
+type responseParser struct {
+	name  string
+	parse func(resp AnthropicResponse) (string, bool)
+}
+
+// responseParsers are tried in order until one finds a message
+var responseParsers = []responseParser{
+	{name: "tool_use", parse: parseToolUseResponse},
+	{name: "text", parse: parseTextResponse},
+}
+
+// parseToolUseResponse reads the message from a structured tool_use block
+func parseToolUseResponse(resp AnthropicResponse) (string, bool) {
+	for _, block := range resp.Content {
+		if block.Type != "tool_use" || len(block.Input) == 0 {
+			continue
+		}
+		var input struct {
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(block.Input, &input); err != nil || input.Message == "" {
+			continue
+		}
+		return input.Message, true
+	}
+	return "", false
+}
+
+// parseTextResponse reads the message from the first non-empty text block
+func parseTextResponse(resp AnthropicResponse) (string, bool) {
+	for _, block := range resp.Content {
+		if block.Type != "" && block.Type != "text" {
+			continue
+		}
+		if strings.TrimSpace(block.Text) != "" {
+			return block.Text, true
+		}
+	}
+	return "", false
+}
+
+// DefaultMaxSubjectLength is the subject line limit asked for when none is configured
+const DefaultMaxSubjectLength = 50
+
+// DefaultMaxLineLength is the longest diff line sent to the API before truncation
+const DefaultMaxLineLength = 1000
+
+// DefaultAPITimeout bounds how long a single API request may take
+const DefaultAPITimeout = 30 * time.Second
+
+// DefaultHTTPTimeout caps every HTTP request. It's a backstop well above
+// DefaultAPITimeout so -timeout still decides how long the API gets.
+const DefaultHTTPTimeout = 5 * time.Minute
+
+// httpTimeout returns the configured HTTP timeout or the default
+func httpTimeout(config *Config) time.Duration {
+	if config != nil {
+		if d, err := time.ParseDuration(config.HTTPTimeout); err == nil && d > 0 {
+			return d
+		}
+	}
+	return DefaultHTTPTimeout
+}
+
+// newHTTPClient returns a client that honors HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY and gives up on requests after timeout
+func newHTTPClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}
+}
+
+// MaxStyleExamples caps how many recent subjects -match-style adds to the prompt
+const MaxStyleExamples = 50
+
+// DefaultStyleExamples is how many recent subjects -match-style uses by default
+const DefaultStyleExamples = 10
+
+// ContextCommandTimeout bounds how long the configured context command may run
+const ContextCommandTimeout = 10 * time.Second
+
+// RepoPromptTemplatePath is the per-repo prompt template, relative to the repo root
+var RepoPromptTemplatePath = filepath.Join(".claude-commit", "prompt.tmpl")
+
+// GenerateOptions holds the per-run flags of the commit command
+type GenerateOptions struct {
+	Verbose    bool
+	Trailers   bool
+	AsciiOnly  bool
+	AddAll     bool
+	All        bool // Stage tracked changes first, like git commit -a
+	Timings    bool
+	Apply      bool
+	Candidates int
+	Timeout    time.Duration
+	Retries    int
+	Scope      string
+	Type       string // Commit type the message must use, e.g. docs; empty lets the model choose
+	Breaking   bool
+	Stdin      bool
+	Amend      bool
+	MatchStyle int    // Number of recent subjects to show as style examples; 0 disables
+	Raw        bool   // Shorthand for Format plain
+	JSON       bool   // Shorthand for Format json
+	Format     string // OutputCommand (default), OutputPlain or OutputJSON
+	Write      bool
+	DryRun     bool // Skip the API call and use placeholderMessage instead
+	Force      bool // Call the API despite too many files or a fallbackMessage
+	// AllowSecrets sends the diff even when scanSecrets matches; it's kept
+	// apart from Force so raising the file limit never skips the scan
+	AllowSecrets bool
+	MaxFiles     int    // Overrides Config.MaxFiles when non-zero
+	Prefix       string // Overrides Config.CommitPrefix when set
+	// TicketFromBranch asks for a Refs footer with the ticket ID found in
+	// the branch name by config.TicketPattern
+	TicketFromBranch bool
+	Hint             string
+	// MessageFile is where -write puts the message; empty means the
+	// repository's COMMIT_EDITMSG
+	MessageFile string
+	// CoAuthors are "Name <email>" values added as Co-authored-by trailers
+	CoAuthors []string
+	NoCache   bool // Neither read nor write the response cache
+	Refresh   bool // Skip cached messages but cache the new ones
+	Edit      bool // Open the message in $EDITOR before using it
+	Body      bool // Ask for a bulleted body below the subject
+	Wrap      int  // Column the body is wrapped at with Body; 0 leaves it as is
+	NoVerify  bool // Skip git's commit hooks when committing
+	Stream    bool // Print the message as it's generated
+	Refine    bool // Ask for changes to the message until the user accepts it
+	Copy      bool // Put the message on the clipboard instead of printing a git command
+	Signoff   bool // Add a Signed-off-by trailer, like Config.Signoff
+	// DryCommit prints the git command -apply or -amend would run instead
+	// of running it
+	DryCommit bool
+	Strict    bool // Fail instead of warning when lintMessage finds problems
+	// CountTokens prints an estimate of the prompt size instead of calling
+	// the API
+	CountTokens bool
+	// IgnoreWhitespace leaves whitespace-only changes out of the diff, like
+	// Config.IgnoreWhitespace
+	IgnoreWhitespace bool
+	// Against describes the changes on HEAD since it forked from this ref,
+	// e.g. main, instead of the staged changes
+	Against string
+	// IncludeUntracked names new files that haven't been added in the
+	// prompt, alongside the staged diff
+	IncludeUntracked bool
+	// Exclude are gitignore-style patterns for files to leave out of the
+	// prompt, applied after the repository's IgnoreFile
+	Exclude []string
+}
+
+// PromptData is the data available to prompt templates
+type PromptData struct {
+	Files       string
+	Diff        string
+	Context     string
+	SubjectCase string
+	Scope       string
+	// Type is the commit type set with -type; empty lets the model choose
+	Type     string
+	Breaking bool
+	// RecentCommits are recent subject lines shown as style examples
+	RecentCommits []string
+	CustomTypes   []string
+	// MaxSubjectLength is the first line limit given to the model
+	MaxSubjectLength int
+	// Hint is a free-form nudge from -hint, e.g. "mention the performance angle"
+	Hint string
+	// Ticket is an issue ID such as PROJ-123 to reference in a Refs footer
+	Ticket string
+	// Language is the language of the description; empty means English
+	Language string
+	// Body asks for a bulleted body after the subject line
+	Body bool
+	// Rules switches guidelines on and off; nil keeps the defaults
+	Rules *CommitRules
+	// Untracked are new files not yet added with git add, listed by name
+	// since they have no diff
+	Untracked []string
+}
+
+type CommitService struct {
+	configService    *ConfigService
+	anthropicService *AnthropicService
+	generators       map[string]CommitGenerator // Keyed by Config.Provider
+	history          *HistoryService
+	cache            *CacheService
+	editor           Editor
+	clipboard        Clipboard
+	gitClient        GitClient
+	runner           CommandRunner
+	fs               FileSystem
+	printer          Printer
+	stderr           Printer // Status output in raw mode, keeping stdout for the message
+	input            io.Reader
+	lines            *bufio.Scanner
+	now              func() time.Time
+}
+
+func NewCommitService(configService *ConfigService, anthropicService *AnthropicService, gitClient GitClient, runner CommandRunner, fs FileSystem, printer Printer) *CommitService {
+	return &CommitService{
+		configService:    configService,
+		anthropicService: anthropicService,
+		generators:       map[string]CommitGenerator{ProviderAnthropic: anthropicService},
+		history:          NewHistoryService(fs, printer),
+		cache:            NewCacheService(fs),
+		editor:           &RealEditor{},
+		clipboard:        &RealClipboard{},
+		gitClient:        gitClient,
+		runner:           runner,
+		fs:               fs,
+		printer:          printer,
+		stderr:           printer,
+		input:            os.Stdin,
+		now:              time.Now,
+	}
+}
+
+func (cs *CommitService) GenerateCommitMessage(opts GenerateOptions) error {
+	out := cs.printer
+	format := opts.outputFormat()
+	if err := validateOutputFormat(format); err != nil {
+		return err
+	}
+	if format != OutputCommand {
+		// Everything but the message goes to stderr so stdout can be piped
+		defer cs.redirectStatus(cs.stderr)()
+	}
+
+	cs.anthropicService.SetVerbose(opts.Verbose)
+	cs.anthropicService.SetMaxRetries(opts.Retries)
+	cs.anthropicService.SetStream(opts.Stream)
+
+	config, err := cs.configService.LoadConfig()
+	if errors.Is(err, ErrConfigNotFound) && (opts.DryRun || opts.CountTokens) {
+		// Neither calls the API, so they work before config is set up
+		config, err = &Config{Model: DefaultModel}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if opts.DryRun && (opts.Apply || opts.Amend) {
+		return fmt.Errorf("-dry-run cannot be combined with -apply or -amend")
+	}
+	if opts.Stream && config.Provider != "" && config.Provider != ProviderAnthropic {
+		return fmt.Errorf("-stream is only supported with the %s provider", ProviderAnthropic)
+	}
+	if opts.Refine && (opts.Stdin || opts.DryRun || opts.CountTokens) {
+		return fmt.Errorf("-refine cannot be combined with -stdin, -dry-run or -count-tokens")
+	}
+	if opts.DryCommit && !opts.Apply && !opts.Amend {
+		return fmt.Errorf("-dry-commit previews -apply or -amend and needs one of them")
+	}
+	if opts.NoVerify && !opts.Apply && !opts.Amend {
+		return fmt.Errorf("-no-verify only applies when committing with -apply or -amend")
+	}
+	if opts.CountTokens && (opts.Apply || opts.Write || opts.Edit) {
+		return fmt.Errorf("-count-tokens only prints an estimate and cannot be combined with -apply, -write or -edit")
+	}
+	if opts.Body && opts.Candidates > 1 {
+		return fmt.Errorf("-body cannot be combined with -n, which lists candidates one per line")
+	}
+	if opts.Wrap < 0 {
+		return fmt.Errorf("-wrap must be 0 or more, got %d", opts.Wrap)
+	}
+	if opts.Stdin && opts.Candidates > 1 {
+		return fmt.Errorf("-n cannot be combined with -stdin, which needs standard input for the diff")
+	}
+	if opts.IncludeUntracked && (opts.Stdin || opts.Amend || opts.Against != "") {
+		return fmt.Errorf("-include-untracked only applies to staged changes and cannot be combined with -stdin, -amend or -against")
+	}
+	if opts.Stdin && opts.Amend {
+		return fmt.Errorf("-amend cannot be combined with -stdin")
+	}
+	if opts.Write && (opts.Apply || opts.Amend) {
+		return fmt.Errorf("-write cannot be combined with -apply or -amend")
+	}
+	if opts.Against != "" && (opts.Stdin || opts.Amend || opts.AddAll || opts.All || opts.Apply) {
+		return fmt.Errorf("-against describes committed changes and cannot be combined with -stdin, -amend, -add-all, -all or -apply")
+	}
+	if opts.Copy && (opts.Apply || opts.Amend || opts.Write || format != OutputCommand) {
+		return fmt.Errorf("-copy cannot be combined with -apply, -amend, -write or a -format other than %s", OutputCommand)
+	}
+	if opts.Edit && opts.Write {
+		return fmt.Errorf("-edit cannot be combined with -write, which already leaves the message to git's editor")
+	}
+	for _, coAuthor := range opts.CoAuthors {
+		if err := validateCoAuthor(coAuthor); err != nil {
+			return err
+		}
+	}
+	// Read before the API call, so a missing identity fails fast
+	var signoff []string
+	if opts.Signoff || config.Signoff {
+		name, email, err := cs.gitClient.GetAuthorIdentity()
+		if err != nil {
+			return err
+		}
+		signoff = []string{signoffTrailer(name, email)}
+	}
+	if opts.Type != "" {
+		if err := validateCommitType(opts.Type, config.CustomTypes); err != nil {
+			return err
+		}
+	}
+
+	timer := newPhaseTimer(cs.now)
+
+	var diff, files string
+	if opts.Stdin {
+		diff, files, err = cs.readDiff()
+	} else if opts.Amend {
+		diff, files, err = cs.lastCommitChanges()
+	} else if opts.Against != "" {
+		diff, files, err = cs.changesAgainst(opts.Against)
+	} else {
+		diff, files, err = cs.stagedChanges(opts.AddAll, opts.All, opts.IgnoreWhitespace || config.IgnoreWhitespace)
+	}
+	if err != nil {
+		return err
+	}
+	if diff, files, err = cs.excludeFiles(diff, files, opts); err != nil {
+		return err
+	}
+	timer.mark("git diff")
+
+	if !opts.DryRun && !opts.CountTokens && !opts.Force {
+		if count, limit := countFiles(files), maxFiles(*config, opts.MaxFiles); count > limit {
+			return fmt.Errorf("%w: %d files changed, the limit is %d", ErrTooManyFiles, count, limit)
+		}
+	}
+	if rules := scanSecrets(diff); len(rules) > 0 {
+		cs.printer.PrintWarning("The diff looks like it contains secrets: " + strings.Join(rules, ", "))
+		if !opts.DryRun && !opts.CountTokens && !opts.AllowSecrets {
+			return ErrSecretsDetected
+		}
+	}
+
+	cs.printer.Print(Dim + "⚙️  Analyzing git diff with Claude AI..." + Reset)
+
+	scope := opts.Scope
+	if scope == "" {
+		scope = inferScope(files)
+	}
+	if opts.Verbose && scope != "" {
+		cs.printer.Print(Dim + "Using scope: " + scope + Reset)
+	}
+
+	data := PromptData{
+		Files:       files,
+		Diff:        preprocessDiff(diff, config.MaxLineLength),
+		Context:     cs.runContextCommand(config.ContextCommand),
+		SubjectCase: subjectCase(*config),
+		Scope:       scope,
+		Type:        opts.Type,
+		Breaking:    opts.Breaking,
+		CustomTypes: config.CustomTypes,
+		// Resolved here so custom prompt templates see the real limit
+		MaxSubjectLength: maxSubjectLength(*config),
+		Hint:             opts.Hint,
+		Language:         config.Language,
+		Body:             opts.Body,
+		Rules:            config.Rules,
+	}
+
+	if opts.TicketFromBranch {
+		data.Ticket, err = cs.branchTicket(*config)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.MatchStyle > 0 {
+		data.RecentCommits, err = cs.gitClient.GetRecentCommits(min(opts.MatchStyle, MaxStyleExamples))
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.IncludeUntracked {
+		data.Untracked, err = cs.gitClient.GetUntrackedFiles()
+		if err != nil {
+			return err
+		}
+	}
+
+	system, prompt, err := cs.preparePrompt(*config, data, opts.Verbose)
+	if err != nil {
+		return err
+	}
+	timer.mark("prompt build")
+
+	maxTokens := MessageMaxTokens
+	if opts.Body {
+		maxTokens = BodyMaxTokens
+	}
+	if opts.CountTokens {
+		cs.printTokenEstimate(system, prompt, maxTokens)
+		return nil
+	}
+
+	ctx, cancel := apiContext(opts.Timeout)
+	defer cancel()
+
+	var candidates []string
+	fallback, useFallback := "", false
+	if !opts.Force {
+		fallback, useFallback = fallbackMessage(diff)
+	}
+
+	if opts.DryRun {
+		cs.printer.PrintWarning("Dry run: skipping the API call and using a placeholder message")
+		candidates = []string{placeholderMessage(files)}
+	} else if useFallback {
+		cs.printer.PrintWarning("The changes only delete files or change binary files, which gives Claude nothing to describe; using a generated message instead (pass -force to call the API anyway)")
+		candidates = []string{fallback}
+	} else {
+		if usesAnthropicKey(*config) {
+			if err := validateAPIKeyFormat(config.ApiKey); err != nil {
+				return fmt.Errorf("%w: %w", ErrInvalidAPIKey, err)
+			}
+		}
+		gen, err := cs.generator(*config)
+		if err != nil {
+			return err
+		}
+		key := cacheKey(*config, system, prompt, opts.Candidates)
+		cached, hit := []string(nil), false
+		if !opts.NoCache && !opts.Refresh {
+			cached, hit = cs.cache.Get(key, cacheTTL(*config))
+		}
+		if hit {
+			cs.printer.Print(Dim + "Using a cached message for this diff (pass -refresh to regenerate)" + Reset)
+			candidates = cached
+		} else {
+			candidates, err = generateCandidates(ctx, gen, *config, system, prompt, opts.Candidates, maxTokens)
+			if err != nil {
+				return err
+			}
+			if !opts.NoCache {
+				cs.cacheCandidates(key, candidates)
+			}
+		}
+	}
+	timer.mark("API call")
+
+	for i, candidate := range candidates {
+		candidates[i], err = postProcessMessage(*config, candidate, opts)
+		if err != nil {
+			return err
+		}
+	}
+	timer.mark("post-processing")
+
+	commitMsg := candidates[0]
+	if len(candidates) > 1 {
+		commitMsg, err = cs.selectCandidate(candidates)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.Refine {
+		if commitMsg, err = cs.refineMessage(*config, system, prompt, commitMsg, maxTokens, opts); err != nil {
+			return err
+		}
+	}
+	prefix := config.CommitPrefix
+	if opts.Prefix != "" {
+		prefix = opts.Prefix
+	}
+	// Added after refining, so the model never sees it and repeats it
+	commitMsg = applyCommitPrefix(commitMsg, prefix, prefixPosition(*config))
+	commitMsg = appendTrailers(commitMsg, append(coAuthorTrailers(opts.CoAuthors), signoff...))
+	if opts.Edit {
+		if commitMsg, err = cs.editMessage(commitMsg); err != nil {
+			return err
+		}
+	}
+
+	var violations []string
+	// Linted without the prefix, which may sit in front of the type
+	linted := stripCommitPrefix(commitMsg, prefix)
+	for _, violation := range lintMessage(linted, commitTypeNames(config.CustomTypes), maxSubjectLength(*config)) {
+		if violation != lintTrailingPeriod || config.Rules.noTrailingPeriod() {
+			violations = append(violations, violation)
+		}
+	}
+	if opts.Strict && len(violations) > 0 {
+		for _, violation := range violations {
+			cs.printer.PrintError(violation)
+		}
+		return fmt.Errorf("commit message failed -strict linting with %d problem(s)", len(violations))
+	}
+
+	cs.printer.PrintSuccess("✓ Commit message generated")
+	for _, violation := range violations {
+		cs.printer.PrintWarning(violation)
+	}
+	if warning := typeWarning(commitMsg); warning != "" {
+		cs.printer.PrintWarning(warning)
+	}
+	cs.printer.Print("")
+
+	applied := false
+	if opts.DryCommit {
+		cs.previewCommit(commitMsg, opts.Amend, CommitOptions{NoVerify: opts.NoVerify})
+	} else if opts.Amend {
+		if applied, err = cs.amend(commitMsg, opts.Apply, CommitOptions{NoVerify: opts.NoVerify}); err != nil {
+			return err
+		}
+	} else if opts.Apply {
+		if err := cs.gitClient.Commit(commitMsg, CommitOptions{NoVerify: opts.NoVerify}); err != nil {
+			return err
+		}
+		applied = true
+		cs.printer.PrintSuccess("✓ Committed: " + commitMsg)
+	} else if opts.Write {
+		path, err := cs.writeEditMsg(opts.MessageFile, commitMsg)
+		if err != nil {
+			return err
+		}
+		cs.printer.PrintSuccess("✓ Wrote message to " + path)
+	} else if opts.Copy {
+		cs.copyMessage(commitMsg)
+	} else if format != OutputCommand {
+		text, err := formatOutput(commitMsg, format, config.Model, opts.Body)
+		if err != nil {
+			return err
+		}
+		out.Print(text)
+	} else if opts.Trailers {
+		cs.printer.Print(formatTrailers(parseConventionalCommit(commitMsg)))
+	} else if strings.Contains(commitMsg, "\n") {
+		// Multi-line messages don't survive copy-pasting as a -m argument
+		path, err := cs.writeMessageFile(commitMsg)
+		if err != nil {
+			return err
+		}
+		cs.printer.Print(commitMsg)
+		cs.printer.Print("")
+		cs.printer.Print(Bold + "git commit -F " + path + Reset)
+	} else {
+		gitCommand, err := formatOutput(commitMsg, OutputCommand, config.Model, opts.Body)
+		if err != nil {
+			return err
+		}
+		cs.printer.Print(Bold + gitCommand + Reset)
+	}
+
+	if !opts.DryRun {
+		cs.recordHistory(HistoryEntry{Time: cs.now(), Model: config.Model, Message: commitMsg, Applied: applied})
+	}
+
+	if opts.Timings {
+		cs.printer.Print("")
+		for _, line := range timer.report() {
+			cs.printer.Print(Dim + line + Reset)
+		}
+	}
+
+	return nil
+}
+
+// copyMessage puts msg on the clipboard, printing it instead when that fails
+// so the message isn't lost
+func (cs *CommitService) copyMessage(msg string) {
+	if err := cs.clipboard.Copy(msg); err != nil {
+		if errors.Is(err, ErrNoClipboard) {
+			cs.printer.PrintWarning("No clipboard command found (install wl-copy, xclip or xsel); printing the message instead")
+		} else {
+			cs.printer.PrintWarning(fmt.Sprintf("Could not copy to the clipboard, printing the message instead: %v", err))
+		}
+		cs.printer.Print(msg)
+		return
+	}
+	cs.printer.PrintSuccess("✓ Copied the message to the clipboard")
+}
+
+// editInstructions follow the message in the file opened by -edit
+const editInstructions = `
+# Edit the commit message above. Lines starting with '#' at the end
+# are removed, and an empty message aborts.
+`
+
+// MaxRefineRounds bounds how many times -refine asks for changes, since
+// every round resends the whole conversation
+const MaxRefineRounds = 10
+
+// refineMessage shows msg and reads instructions such as "make it shorter",
+// sending each with the conversation so far, until the user presses Enter
+// on an empty line
+func (cs *CommitService) refineMessage(config Config, system, prompt, msg string, maxTokens int, opts GenerateOptions) (string, error) {
+	var turns []RefineTurn
+	for len(turns) < MaxRefineRounds {
+		cs.printer.Print(Bold + "Message: " + Reset + msg)
+		cs.printer.Print(`Refine it (e.g. "make it shorter"), or press Enter to keep it: `)
+		instruction, err := cs.readLine()
+		if err != nil {
+			return "", err
+		}
+		if instruction == "" {
+			return msg, nil
+		}
+
+		turns = append(turns, RefineTurn{Reply: msg, Instruction: instruction})
+		reply, err := cs.refineReply(config, system, buildConversation(prompt, turns), maxTokens, opts.Timeout)
+		if err != nil {
+			return "", err
+		}
+		if msg, err = postProcessMessage(config, reply, opts); err != nil {
+			return "", err
+		}
+	}
+
+	cs.printer.PrintWarning(fmt.Sprintf("Stopped refining after %d rounds", MaxRefineRounds))
+	return msg, nil
+}
+
+// refineReply sends one refine round with its own apiContext, so the time
+// the user spends typing an instruction doesn't count against the timeout
+func (cs *CommitService) refineReply(config Config, system string, messages []Message, maxTokens int, timeout time.Duration) (string, error) {
+	gen, err := cs.generator(config)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := apiContext(timeout)
+	defer cancel()
+	return gen.GenerateConversation(ctx, config, system, messages, maxTokens)
+}
+
+// editMessage lets the user revise msg in their editor
+func (cs *CommitService) editMessage(msg string) (string, error) {
+	edited, err := cs.editor.Edit(msg + "\n" + editInstructions)
+	if err != nil {
+		return "", err
+	}
+	edited = cleanEditedMessage(edited)
+	if edited == "" {
+		return "", fmt.Errorf("aborting: the edited commit message is empty")
+	}
+	return edited, nil
+}
+
+// cleanEditedMessage drops trailing "# " comment lines and surrounding
+// whitespace. Other lines starting with # are kept, since "#123" may be an
+// issue reference.
+func cleanEditedMessage(text string) string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for len(lines) > 0 {
+		last := strings.TrimSpace(lines[len(lines)-1])
+		if last != "" && last != "#" && !strings.HasPrefix(last, "# ") {
+			break
+		}
+		lines = lines[:len(lines)-1]
+	}
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// cacheCandidates saves freshly generated candidates, warning instead of
+// failing since the message has already been generated
+func (cs *CommitService) cacheCandidates(key string, candidates []string) {
+	if err := cs.cache.Put(key, candidates); err != nil {
+		cs.printer.PrintWarning(fmt.Sprintf("Could not cache the message: %v", err))
+	}
+}
+
+// recordHistory appends entry to the history file, warning instead of
+// failing since the message has already been generated
+func (cs *CommitService) recordHistory(entry HistoryEntry) {
+	if cs.history == nil {
+		return
+	}
+	if err := cs.history.Append(entry); err != nil {
+		cs.printer.PrintWarning(fmt.Sprintf("Could not save message history: %v", err))
+	}
+}
+
+// DryRunMaxFiles is how many file names a placeholder message lists
+const DryRunMaxFiles = 3
+
+// placeholderMessage derives a stand-in commit message from the staged file
+// list for -dry-run, e.g. "chore: update main.go, util.go"
+func placeholderMessage(files string) string {
+	return "chore: update " + listFileNames(strings.Split(files, "\n"))
+}
+
+// listFileNames joins the base names of files for a message subject,
+// naming at most DryRunMaxFiles of them
+func listFileNames(files []string) string {
+	var names []string
+	for _, file := range files {
+		if file = strings.TrimSpace(file); file != "" {
+			names = append(names, filepath.Base(file))
+		}
+	}
+
+	switch {
+	case len(names) == 0:
+		return "files"
+	case len(names) > DryRunMaxFiles:
+		return fmt.Sprintf("%s and %d more", strings.Join(names[:DryRunMaxFiles], ", "), len(names)-DryRunMaxFiles)
+	default:
+		return strings.Join(names, ", ")
+	}
+}
+
+// fallbackMessage returns a message for a diff made only of deleted files
+// and binary changes, which give the model nothing to describe, e.g.
+// "chore: remove old.go, legacy.go". ok is false for any other diff.
+func fallbackMessage(diff string) (msg string, ok bool) {
+	var files []string
+	allDeleted, allAdded := true, true
+	var section []string
+	check := func() bool {
+		if len(section) == 0 || !strings.HasPrefix(section[0], "diff --git ") {
+			return true
+		}
+		deleted, added := false, false
+		for _, line := range section {
+			deleted = deleted || strings.HasPrefix(line, "deleted file mode")
+			added = added || strings.HasPrefix(line, "new file mode")
+		}
+		if !deleted && !isSuppressedSection(section) {
+			return false
+		}
+		files = append(files, filesFromDiff(section[0])...)
+		allDeleted = allDeleted && deleted
+		allAdded = allAdded && added
+		return true
+	}
+
+	for _, line := range strings.Split(diff, "\n") {
+		if strings.HasPrefix(line, "diff --git ") {
+			if !check() {
+				return "", false
+			}
+			section = nil
+		}
+		section = append(section, line)
+	}
+	if !check() || len(files) == 0 {
+		return "", false
+	}
+
+	switch {
+	case allDeleted:
+		return "chore: remove " + listFileNames(files), true
+	case allAdded:
+		return "chore: add " + listFileNames(files), true
+	default:
+		return "chore: update " + listFileNames(files), true
+	}
+}
+
+// SecretRule flags a likely credential in a diff
+type SecretRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	// MinEntropy, when set, also requires the pattern's first group to look
+	// random enough (in bits per character) to be a real token
+	MinEntropy float64
+}
+
+// SecretRules are checked by scanSecrets before a diff is sent to the API
+var SecretRules = []SecretRule{
+	{Name: "AWS access key", Pattern: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{Name: "private key", Pattern: regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)},
+	{
+		Name:       "high-entropy token",
+		Pattern:    regexp.MustCompile(`(?i)(?:key|secret|token|password|passwd)\w*["']?\s*[:=]\s*["']?([A-Za-z0-9_\-+/=]{20,})`),
+		MinEntropy: 4.0,
+	},
+}
+
+// scanSecrets returns the names of the SecretRules that match diff, in rule
+// order. Assignments like api_key = "..." only count when the value looks
+// random, so placeholders and variable names don't trip it
+func scanSecrets(diff string) []string {
+	var matched []string
+	for _, rule := range SecretRules {
+		for _, m := range rule.Pattern.FindAllStringSubmatch(diff, -1) {
+			if rule.MinEntropy == 0 || shannonEntropy(m[1]) >= rule.MinEntropy {
+				matched = append(matched, rule.Name)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// shannonEntropy returns the bits of entropy per character of s
+func shannonEntropy(s string) float64 {
+	counts := make(map[rune]int)
+	for _, r := range s {
+		counts[r]++
+	}
+	n := float64(utf8.RuneCountInString(s))
+	var entropy float64
+	for _, c := range counts {
+		p := float64(c) / n
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// maxSubjectLength returns the configured subject line limit or the default
+func maxSubjectLength(config Config) int {
+	if config.Rules != nil && config.Rules.MaxLength > 0 {
+		return config.Rules.MaxLength
+	}
+	if config.MaxSubjectLength > 0 {
+		return config.MaxSubjectLength
+	}
+	return DefaultMaxSubjectLength
+}
+
+// ModelContextWindow is the context window of the Claude models, in tokens.
+// The prompt and the response both have to fit in it.
+const ModelContextWindow = 200000
+
+// CharsPerToken is the rough number of characters in a token, used to
+// estimate the prompt size without calling the API
+const CharsPerToken = 4
+
+// estimateTokens guesses how many tokens text is, rounding up
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + CharsPerToken - 1) / CharsPerToken
+}
+
+// tokenWarning explains when a prompt of the given size leaves no room for
+// a response of maxTokens, or returns an empty string
+func tokenWarning(estimate, maxTokens int) string {
+	if estimate+maxTokens <= ModelContextWindow {
+		return ""
+	}
+	return fmt.Sprintf("The prompt is likely too big for the model's %d-token context window; split the commit, or lower max_line_length in the config to truncate long diff lines", ModelContextWindow)
+}
+
+// printTokenEstimate shows the estimated size of the prompt that would be
+// sent, warning when it won't fit in the context window
+func (cs *CommitService) printTokenEstimate(system, prompt string, maxTokens int) {
+	estimate := estimateTokens(system) + estimateTokens(prompt)
+	cs.printer.Print(Bold + "Estimated prompt size: " + Reset + fmt.Sprintf("~%d tokens (%d characters / %d)", estimate, utf8.RuneCountInString(system)+utf8.RuneCountInString(prompt), CharsPerToken))
+	if warning := tokenWarning(estimate, maxTokens); warning != "" {
+		cs.printer.PrintWarning(warning)
+	}
+}
+
+// DefaultMaxFiles is how many changed files a message is generated for
+// before asking the user to split the commit, e.g. after staging a vendored
+// directory by accident
+const DefaultMaxFiles = 100
+
+// maxFiles returns the changed file limit, preferring the -max-files flag
+// over the config
+func maxFiles(config Config, flag int) int {
+	if flag > 0 {
+		return flag
+	}
+	if config.MaxFiles > 0 {
+		return config.MaxFiles
+	}
+	return DefaultMaxFiles
+}
+
+// countFiles counts the paths in git's --name-only output, ignoring blank
+// lines and the trailing newline
+func countFiles(files string) int {
+	count := 0
+	for _, line := range strings.Split(files, "\n") {
+		if strings.TrimSpace(line) != "" {
+			count++
+		}
+	}
+	return count
+}
+
+// subjectLengthWarning describes how far the first line of msg goes over
+// limit, or returns an empty string when it fits
+func subjectLengthWarning(msg string, limit int) string {
+	subject, _, _ := strings.Cut(msg, "\n")
+	if length := utf8.RuneCountInString(subject); length > limit {
+		return fmt.Sprintf("Subject line is %d characters, over the %d character limit", length, limit)
+	}
+	return ""
+}
+
+// typeWarning flags a commit type that isn't plain ASCII, which happens when
+// the model translates the type along with the description
+func typeWarning(msg string) string {
+	subject, _, _ := strings.Cut(msg, "\n")
+	prefix, _, found := strings.Cut(subject, ":")
+	if !found {
+		return ""
+	}
+	for _, r := range prefix {
+		if r > unicode.MaxASCII {
+			return fmt.Sprintf("Commit type %q isn't ASCII; conventional commit types should stay in English", prefix)
+		}
+	}
+	return ""
+}
+
+// generator returns the CommitGenerator for the configured provider
+func (cs *CommitService) generator(config Config) (CommitGenerator, error) {
+	provider := config.Provider
+	if provider == "" {
+		provider = ProviderAnthropic
+	}
+	gen, ok := cs.generators[provider]
+	if !ok {
+		return nil, validateProvider(provider)
+	}
+	return gen, nil
+}
+
+// writeMessageFile saves msg to a temp file for use with git commit -F and
+// returns its path
+func (cs *CommitService) writeMessageFile(msg string) (string, error) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("claude-commit-%d.txt", cs.now().UnixNano()))
+	if err := cs.fs.WriteFile(path, []byte(msg+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("error writing commit message file: %w", err)
+	}
+	return path, nil
+}
+
+// CommitEditMsgFile is the file under the git dir that git commit opens in
+// the editor
+const CommitEditMsgFile = "COMMIT_EDITMSG"
+
+// writeEditMsg puts msg at the top of the commit message file at path, or
+// the repository's COMMIT_EDITMSG when path is empty. Git's comment lines
+// already in the file are kept below the message; anything else is replaced.
+func (cs *CommitService) writeEditMsg(path, msg string) (string, error) {
+	if path == "" {
+		gitDir, err := cs.gitClient.GetGitDir()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(gitDir, CommitEditMsgFile)
+	}
+
+	existing, err := cs.fs.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("error reading commit message file: %w", err)
+	}
+
+	var comments []string
+	for _, line := range strings.Split(string(existing), "\n") {
+		if strings.HasPrefix(line, "#") {
+			comments = append(comments, line)
+		}
+	}
+
+	content := msg + "\n"
+	if len(comments) > 0 {
+		content += "\n" + strings.Join(comments, "\n") + "\n"
+	}
+	if err := cs.fs.WriteFile(path, []byte(content), 0644); err != nil {
+		return "", fmt.Errorf("error writing commit message file: %w", err)
+	}
+	return path, nil
+}
+
+// apiContext returns a context that expires after timeout, falling back to
+// DefaultAPITimeout when no timeout is set
+func apiContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = DefaultAPITimeout
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// excludeFiles leaves the files matched by the repository's IgnoreFile and
+// -exclude patterns out of diff and files. A diff from -stdin isn't tied to
+// the repository, so only -exclude applies to it.
+func (cs *CommitService) excludeFiles(diff, files string, opts GenerateOptions) (string, string, error) {
+	rules := &IgnoreRules{}
+	if !opts.Stdin {
+		root, err := cs.gitClient.GetRepoRoot()
+		if err != nil {
+			return "", "", err
+		}
+		if rules, err = loadIgnoreFile(cs.fs, root); err != nil {
+			return "", "", err
+		}
+	}
+	rules.add(opts.Exclude)
+	if rules.empty() {
+		return diff, files, nil
+	}
+
+	kept := rules.filterFiles(files)
+	if removed := countFiles(files) - countFiles(kept); removed > 0 && opts.Verbose {
+		cs.printer.Print(Dim + fmt.Sprintf("Excluded %d file(s) matched by %s or -exclude", removed, IgnoreFile) + Reset)
+	}
+	if strings.TrimSpace(kept) == "" && strings.TrimSpace(files) != "" {
+		return "", "", fmt.Errorf("%w: every changed file is excluded by %s or -exclude", ErrNoStagedChanges, IgnoreFile)
+	}
+	return rules.filterDiff(diff), kept, nil
+}
+
+// redirectStatus sends status output of the service and its API calls to p
+// until the returned function restores the original printers
+func (cs *CommitService) redirectStatus(p Printer) func() {
+	printer, apiPrinter := cs.printer, cs.anthropicService.printer
+	cs.printer, cs.anthropicService.printer = p, p
+	return func() {
+		cs.printer, cs.anthropicService.printer = printer, apiPrinter
+	}
+}
+
+// stagedChanges returns the staged diff and file list, first staging
+// everything with addAll or only tracked files with tracked. With
+// ignoreWhitespace, whitespace-only changes are left out of the diff unless
+// that's all there is.
+func (cs *CommitService) stagedChanges(addAll, tracked, ignoreWhitespace bool) (string, string, error) {
+	if addAll {
+		cs.printer.PrintWarning("Staging all changes with 'git add -A', including untracked and deleted files")
+		if err := cs.gitClient.StageAll(); err != nil {
+			return "", "", err
+		}
+	} else if tracked {
+		if err := cs.gitClient.StageTracked(); err != nil {
+			return "", "", err
+		}
+	}
+
+	diff, err := cs.gitClient.GetStagedDiff()
+	if err != nil {
+		return "", "", err
+	}
+
+	if ignoreWhitespace && strings.TrimSpace(diff) != "" {
+		trimmed, err := cs.gitClient.GetStagedDiffOptions(true)
+		if err != nil {
+			return "", "", err
+		}
+		if strings.TrimSpace(trimmed) == "" {
+			// Sending nothing would leave the model guessing
+			cs.printer.PrintWarning("The staged changes are whitespace-only, sending the full diff")
+		} else {
+			diff = trimmed
+		}
+	}
+
+	files, err := cs.gitClient.GetStagedFiles()
+	if err != nil {
+		return "", "", err
+	}
+
+	if strings.TrimSpace(diff) == "" {
+		if strings.TrimSpace(files) == "" {
+			return "", "", ErrNoStagedChanges
+		}
+
+		// Binary-only or mode-only changes can leave the textual diff empty
+		summary, err := cs.gitClient.GetStagedSummary()
+		if err != nil {
+			return "", "", err
+		}
+		diff = fallbackDiff(files, summary)
+	}
+
+	return diff, files, nil
+}
+
+// branchTicket returns the ticket ID in the current branch name, warning
+// rather than failing when there isn't one
+func (cs *CommitService) branchTicket(config Config) (string, error) {
+	branch, err := cs.gitClient.GetCurrentBranch()
+	if err != nil {
+		return "", err
+	}
+	ticket, err := ticketFromBranch(branch, config.TicketPattern)
+	if err != nil {
+		return "", err
+	}
+	if ticket == "" {
+		cs.printer.PrintWarning(fmt.Sprintf("No ticket ID found in branch %q, leaving out the Refs footer", branch))
+	}
+	return ticket, nil
+}
+
+// changesAgainst returns the diff and file list of HEAD since it forked
+// from ref
+func (cs *CommitService) changesAgainst(ref string) (string, string, error) {
+	if strings.HasPrefix(ref, "-") {
+		return "", "", fmt.Errorf("invalid ref %q", ref)
+	}
+	diff, err := cs.gitClient.GetDiffAgainst(ref)
+	if err != nil {
+		return "", "", err
+	}
+	if strings.TrimSpace(diff) == "" {
+		return "", "", fmt.Errorf("no changes between %s and HEAD", ref)
+	}
+	files, err := cs.gitClient.GetFilesAgainst(ref)
+	if err != nil {
+		return "", "", err
+	}
+	return diff, files, nil
+}
+
+// lastCommitChanges returns the diff and file list of the last commit
+func (cs *CommitService) lastCommitChanges() (string, string, error) {
+	diff, err := cs.gitClient.GetLastCommitDiff()
+	if err != nil {
+		return "", "", err
+	}
+	return diff, strings.Join(filesFromDiff(diff), "\n"), nil
+}
+
+// amend rewrites the last commit's message, asking first unless confirmed
+func (cs *CommitService) amend(msg string, confirmed bool, commitOpts CommitOptions) (bool, error) {
+	if !confirmed {
+		cs.printer.Print(Bold + msg + Reset)
+		cs.printer.Print("Amend the last commit with this message? [y/N]: ")
+		answer, err := cs.readLine()
+		if err != nil {
+			return false, err
+		}
+		if answer = strings.ToLower(answer); answer != "y" && answer != "yes" {
+			gitCommand := "git commit --amend -m " + shellQuote(msg)
+			cs.printer.Print(Bold + gitCommand + Reset)
+			return false, nil
+		}
+	}
+
+	if err := cs.gitClient.AmendCommit(msg, commitOpts); err != nil {
+		return false, err
+	}
+	cs.printer.PrintSuccess("✓ Amended: " + msg)
+	return true, nil
+}
+
+// previewCommit prints the git command and message that committing, or with
+// amend amending, would use, without running git
+func (cs *CommitService) previewCommit(msg string, amend bool, commitOpts CommitOptions) {
+	cs.printer.PrintWarning("Dry commit: nothing was committed")
+	cs.printer.Print(Bold + "git " + strings.Join(commitArgs(amend, commitOpts), " ") + Reset)
+	cs.printer.Print(Dim + "with this message on stdin:" + Reset)
+	cs.printer.Print(msg)
+}
+
+// readLine reads the next trimmed line of input, or "" at end of input
+func (cs *CommitService) readLine() (string, error) {
+	if cs.lines == nil {
+		cs.lines = bufio.NewScanner(cs.input)
+	}
+	if !cs.lines.Scan() {
+		if err := cs.lines.Err(); err != nil {
+			return "", fmt.Errorf("error reading input: %w", err)
+		}
+		return "", nil
+	}
+	return strings.TrimSpace(cs.lines.Text()), nil
+}
+
+// readDiff reads a diff from the service's input instead of git, deriving
+// the file list from its headers
+func (cs *CommitService) readDiff() (string, string, error) {
+	data, err := io.ReadAll(cs.input)
+	if err != nil {
+		return "", "", fmt.Errorf("error reading diff from stdin: %w", err)
+	}
+
+	diff := string(data)
+	if strings.TrimSpace(diff) == "" {
+		return "", "", fmt.Errorf("no diff received on stdin")
+	}
+	return diff, strings.Join(filesFromDiff(diff), "\n"), nil
+}
+
+// styleExampleCount returns how many recent subjects to use, or 0 when
+// -match-style is off
+func styleExampleCount(matchStyle bool, n int) int {
+	if !matchStyle {
+		return 0
+	}
+	return n
+}
+
+// postProcessMessage applies sanitizeMessage, the -type, configured casing,
+// type template and ASCII transliteration to a generated message
+func postProcessMessage(config Config, msg string, opts GenerateOptions) (string, error) {
+	msg = sanitizeMessage(msg)
+	if opts.Type != "" {
+		msg = forceCommitType(msg, opts.Type)
+	}
+	msg = applySubjectCase(msg, subjectCase(config))
+	msg, err := applyTypeTemplate(msg, config.TemplatesByType)
+	if err != nil {
+		return "", err
+	}
+	if opts.AsciiOnly || config.AsciiOnly {
+		msg = toASCII(msg)
+	}
+	if opts.Body && opts.Wrap > 0 {
+		// The subject is never wrapped; its length is checked separately
+		if subject, body, found := strings.Cut(msg, "\n"); found {
+			msg = subject + "\n" + wrapText(body, opts.Wrap)
+		}
+	}
+	return msg, nil
+}
+
+// listMarkerPattern matches the marker and indentation starting a list item,
+// e.g. "- " or "  2. "
+var listMarkerPattern = regexp.MustCompile(`^\s*(?:[-*+]|\d+[.)])\s+`)
+
+// wrapText wraps each line of body at width columns, breaking only between
+// words. Blank lines are kept, and a list item's continuation lines are
+// indented to line up after its marker rather than breaking it. A word
+// longer than width gets a line to itself.
+func wrapText(body string, width int) string {
+	lines := strings.Split(body, "\n")
+	var wrapped []string
+	for _, line := range lines {
+		if utf8.RuneCountInString(line) <= width {
+			wrapped = append(wrapped, line)
+			continue
+		}
+		lead := listMarkerPattern.FindString(line)
+		if lead == "" {
+			lead = line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		}
+		indent := strings.Repeat(" ", utf8.RuneCountInString(lead))
+
+		current := lead
+		empty := true
+		for _, word := range strings.Fields(line[len(lead):]) {
+			if !empty && utf8.RuneCountInString(current)+1+utf8.RuneCountInString(word) > width {
+				wrapped = append(wrapped, current)
+				current, empty = indent, true
+			}
+			if !empty {
+				current += " "
+			}
+			current += word
+			empty = false
+		}
+		wrapped = append(wrapped, current)
+	}
+	return strings.Join(wrapped, "\n")
+}
+
+// messagePreamblePattern matches a lead-in such as "Here is your commit
+// message:" on the first line of a reply
+var messagePreamblePattern = regexp.MustCompile(`(?i)^(?:here(?:'s| is) (?:the |your |a )?(?:suggested |proposed |generated |conventional )?commit message|commit message)\s*:\s*`)
+
+// messageQuotes are the opening and closing quotes sanitizeMessage strips
+var messageQuotes = [][2]string{{`"`, `"`}, {"'", "'"}, {"“", "”"}, {"‘", "’"}}
+
+// sanitizeMessage removes what the model sometimes wraps a message in: a
+// "Here is your commit message:" preamble, a code fence, backticks or
+// quotes. Each is only stripped when it encloses the whole message, so
+// quotes or backticks inside the message are kept.
+func sanitizeMessage(msg string) string {
+	msg = strings.TrimSpace(msg)
+	for {
+		cleaned := msg
+		if loc := messagePreamblePattern.FindStringIndex(cleaned); loc != nil && strings.TrimSpace(cleaned[loc[1]:]) != "" {
+			cleaned = strings.TrimSpace(cleaned[loc[1]:])
+		}
+		cleaned = stripCodeFence(cleaned)
+		for _, fence := range []string{"``", "`"} {
+			if len(cleaned) > 2*len(fence) && strings.HasPrefix(cleaned, fence) && strings.HasSuffix(cleaned, fence) &&
+				strings.Count(cleaned, "`") == 2*len(fence) {
+				cleaned = strings.TrimSpace(cleaned[len(fence) : len(cleaned)-len(fence)])
+				break
+			}
+		}
+		for _, q := range messageQuotes {
+			inner, ok := strings.CutPrefix(cleaned, q[0])
+			if !ok {
+				continue
+			}
+			inner, ok = strings.CutSuffix(inner, q[1])
+			if ok && inner != "" && !strings.Contains(inner, q[0]) && !strings.Contains(inner, q[1]) {
+				cleaned = strings.TrimSpace(inner)
+				break
+			}
+		}
+
+		if cleaned == msg {
+			return msg
+		}
+		msg = cleaned
+	}
+}
+
+// stripCodeFence removes a ``` fence, with an optional language tag, that
+// encloses the whole of msg
+func stripCodeFence(msg string) string {
+	lines := strings.Split(msg, "\n")
+	if len(lines) < 3 {
+		return msg
+	}
+	first, last := strings.TrimSpace(lines[0]), strings.TrimSpace(lines[len(lines)-1])
+	if !strings.HasPrefix(first, "```") || strings.Contains(first[3:], "`") || strings.ContainsAny(first[3:], " \t") || last != "```" {
+		return msg
+	}
+	return strings.TrimSpace(strings.Join(lines[1:len(lines)-1], "\n"))
+}
+
+// selectCandidate prints a numbered menu of candidates and reads the chosen
+// number from the service's input
+func (cs *CommitService) selectCandidate(candidates []string) (string, error) {
+	cs.printer.Print(Bold + "Candidates:" + Reset)
+	for i, candidate := range candidates {
+		cs.printer.Print(fmt.Sprintf("  %d. %s", i+1, candidate))
+	}
+	cs.printer.Print(fmt.Sprintf("Select a message [1-%d]: ", len(candidates)))
+
+	choice, err := cs.readLine()
+	if err != nil {
+		return "", err
+	}
+	if choice == "" {
+		return "", fmt.Errorf("no selection made")
+	}
+
+	index, err := strconv.Atoi(choice)
+	if err != nil || index < 1 || index > len(candidates) {
+		return "", fmt.Errorf("invalid selection %q: enter a number from 1 to %d", choice, len(candidates))
+	}
+	return candidates[index-1], nil
+}
+
+// phaseTimer records how long each phase of a run takes
+type phaseTimer struct {
+	now    func() time.Time
+	start  time.Time
+	last   time.Time
+	phases []phaseTiming
+}
+
+type phaseTiming struct {
+	name     string
+	duration time.Duration
+}
+
+func newPhaseTimer(now func() time.Time) *phaseTimer {
+	start := now()
+	return &phaseTimer{now: now, start: start, last: start}
+}
+
+// mark ends the current phase, recording the time since the previous mark
+func (pt *phaseTimer) mark(name string) {
+	t := pt.now()
+	pt.phases = append(pt.phases, phaseTiming{name: name, duration: t.Sub(pt.last)})
+	pt.last = t
+}
+
+// report formats the recorded phases and the total as aligned lines
+func (pt *phaseTimer) report() []string {
+	lines := []string{"Timings:"}
+	for _, phase := range pt.phases {
+		lines = append(lines, fmt.Sprintf("  %-16s %v", phase.name, phase.duration.Round(time.Millisecond)))
+	}
+	lines = append(lines, fmt.Sprintf("  %-16s %v", "total", pt.last.Sub(pt.start).Round(time.Millisecond)))
+	return lines
+}
+
+// preparePrompt renders the prompt for data using the resolved template
+func (cs *CommitService) preparePrompt(config Config, data PromptData, verbose bool) (string, string, error) {
+	tmpl, source, err := cs.resolvePromptTemplate(config)
+	if err != nil {
+		return "", "", err
+	}
+	if verbose {
+		cs.printer.Print(Dim + "Using prompt template: " + source + Reset)
+	}
+
+	if tmpl == "" {
+		return cs.buildSystemPrompt(data), cs.buildPrompt(data), nil
+	}
+	// A template replaces the whole built-in prompt, rules included
+	prompt, err := renderPromptTemplate(tmpl, data)
+	return "", prompt, err
+}
+
+// ReviewUnpushedCommits suggests an improved message for each commit that
+// is ahead of the upstream branch, shown next to the original
+func (cs *CommitService) ReviewUnpushedCommits() error {
+	config, err := cs.configService.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	gen, err := cs.generator(*config)
+	if err != nil {
+		return err
+	}
+
+	shas, err := cs.gitClient.GetUnpushedCommits()
+	if err != nil {
+		return err
+	}
+
+	if len(shas) == 0 {
+		cs.printer.PrintSuccess("No unpushed commits to review")
+		return nil
+	}
+
+	cs.printer.Print(Dim + fmt.Sprintf("⚙️  Reviewing %d unpushed commits with Claude AI...", len(shas)) + Reset)
+
+	for _, sha := range shas {
+		subject, err := cs.gitClient.GetCommitSubject(sha)
+		if err != nil {
+			return err
+		}
+		diff, err := cs.gitClient.GetCommitDiff(sha)
+		if err != nil {
+			return err
+		}
+
+		data := PromptData{
+			Files:       strings.Join(filesFromDiff(diff), "\n"),
+			Diff:        preprocessDiff(diff, config.MaxLineLength),
+			SubjectCase: subjectCase(*config),
+			// Resolved here so custom prompt templates see the real limit
+			MaxSubjectLength: maxSubjectLength(*config),
+			Rules:            config.Rules,
+		}
+		system, prompt, err := cs.preparePrompt(*config, data, false)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := apiContext(DefaultAPITimeout)
+		suggestion, err := gen.Generate(ctx, *config, system, prompt, MessageMaxTokens)
+		cancel()
+		if err != nil {
+			return err
+		}
+		suggestion = applySubjectCase(sanitizeMessage(suggestion), subjectCase(*config))
+		if config.AsciiOnly {
+			suggestion = toASCII(suggestion)
+		}
+
+		cs.printer.Print("")
+		cs.printer.Print(Bold + Yellow + shortSHA(sha) + Reset)
+		cs.printer.Print("  " + Dim + "Original:  " + Reset + subject)
+		cs.printer.Print("  " + Bold + "Suggested: " + Reset + Green + suggestion + Reset)
+	}
+
+	return nil
+}
+
+// filesFromDiff lists the files touched by a diff, taken from its
+// "diff --git a/<path> b/<path>" headers
+func filesFromDiff(diff string) []string {
+	var files []string
+	for _, line := range strings.Split(diff, "\n") {
+		if !strings.HasPrefix(line, "diff --git ") {
+			continue
+		}
+		idx := strings.LastIndex(line, " b/")
+		if idx == -1 {
+			continue
+		}
+		files = append(files, line[idx+len(" b/"):])
+	}
+	return files
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
+
+// SquashCommit is one of the commits being squashed together
+type SquashCommit struct {
+	SHA     string
+	Subject string
+	Diff    string
+}
+
+// GenerateSquashMessage generates a single message summarizing the given
+// commits. Arguments may be individual SHAs (not necessarily contiguous) or
+// ranges such as main..HEAD.
+func (cs *CommitService) GenerateSquashMessage(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no commits given. Pass commit SHAs or a range such as main..HEAD")
+	}
+
+	config, err := cs.configService.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	shas, err := cs.resolveCommits(args)
+	if err != nil {
+		return err
+	}
+
+	commits := make([]SquashCommit, 0, len(shas))
+	for _, sha := range shas {
+		subject, err := cs.gitClient.GetCommitSubject(sha)
+		if err != nil {
+			return err
+		}
+		diff, err := cs.gitClient.GetCommitDiff(sha)
+		if err != nil {
+			return err
+		}
+		commits = append(commits, SquashCommit{
+			SHA:     sha,
+			Subject: subject,
+			Diff:    preprocessDiff(diff, config.MaxLineLength),
+		})
+	}
+
+	cs.printer.Print(Dim + fmt.Sprintf("⚙️  Summarizing %d commits with Claude AI...", len(commits)) + Reset)
+
+	ctx, cancel := apiContext(DefaultAPITimeout)
+	defer cancel()
+
+	gen, err := cs.generator(*config)
+	if err != nil {
+		return err
+	}
+	// The same system prompt as a regular commit, so the configured rules,
+	// language, custom types and subject case apply to squashes too
+	system := cs.buildSystemPrompt(PromptData{
+		SubjectCase:      subjectCase(*config),
+		CustomTypes:      config.CustomTypes,
+		MaxSubjectLength: maxSubjectLength(*config),
+		Language:         config.Language,
+		Rules:            config.Rules,
+	})
+	commitMsg, err := gen.Generate(ctx, *config, system, buildSquashPrompt(commits), MessageMaxTokens)
+	if err != nil {
+		return err
+	}
+
+	commitMsg = applySubjectCase(sanitizeMessage(commitMsg), subjectCase(*config))
+	if config.AsciiOnly {
+		commitMsg = toASCII(commitMsg)
+	}
+
+	cs.printer.PrintSuccess("✓ Squash message generated")
+	cs.printer.Print("")
+	cs.printer.Print(commitMsg)
+
+	return nil
+}
+
+// resolveCommits expands ranges into their commits and drops duplicates,
+// keeping the order in which commits were given
+func (cs *CommitService) resolveCommits(args []string) ([]string, error) {
+	var shas []string
+	seen := make(map[string]bool)
+	for _, arg := range args {
+		expanded := []string{arg}
+		if strings.Contains(arg, "..") {
+			var err error
+			expanded, err = cs.gitClient.GetCommitRange(arg)
+			if err != nil {
+				return nil, err
+			}
+			if len(expanded) == 0 {
+				return nil, fmt.Errorf("no commits found in range %s", arg)
+			}
+		}
+		for _, sha := range expanded {
+			if !seen[sha] {
+				seen[sha] = true
+				shas = append(shas, sha)
+			}
+		}
+	}
+	return shas, nil
+}
+
+// buildSquashPrompt returns the user message for a squash: each commit's
+// subject and diff, in order
+func buildSquashPrompt(commits []SquashCommit) string {
+	var b strings.Builder
+	b.WriteString("Generate a single conventional commit message that summarizes the following commits, which are being squashed into one. Describe the combined effect of the commits, not each commit separately.\n")
+
+	for i, commit := range commits {
+		fmt.Fprintf(&b, "\nCommit %d (%s): %s\n", i+1, commit.SHA, commit.Subject)
+		fmt.Fprintf(&b, "Diff:\n%s\n", commit.Diff)
+	}
+
+	b.WriteString("\nCommit message:")
+	return b.String()
+}
+
+// ChangelogMaxTokens leaves room for a changelog covering many commits
+const ChangelogMaxTokens = 2000
+
+// GenerateChangelog prints a Markdown changelog entry, grouped by kind of
+// change, for the commits between since and HEAD. Status output goes to
+// stderr so the entry can be redirected into a file.
+func (cs *CommitService) GenerateChangelog(since string) error {
+	out := cs.printer
+	defer cs.redirectStatus(cs.stderr)()
+
+	if since == "" {
+		return fmt.Errorf("no ref given. Pass -since with a tag or commit, e.g. -since v1.2.0")
+	}
+	if strings.HasPrefix(since, "-") {
+		return fmt.Errorf("invalid ref %q", since)
+	}
+
+	config, err := cs.configService.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	shas, err := cs.gitClient.GetCommitRange(since + "..HEAD")
+	if errors.Is(err, ErrUnknownRef) {
+		return fmt.Errorf("%w: %q isn't a tag, branch or commit", ErrUnknownRef, since)
+	}
+	if err != nil {
+		return err
+	}
+	if len(shas) == 0 {
+		return fmt.Errorf("no changes since %s", since)
+	}
+
+	subjects := make([]string, 0, len(shas))
+	for _, sha := range shas {
+		subject, err := cs.gitClient.GetCommitSubject(sha)
+		if err != nil {
+			return err
+		}
+		subjects = append(subjects, subject)
+	}
+	diff, err := cs.gitClient.GetDiffAgainst(since)
+	if err != nil {
+		return err
+	}
+
+	cs.printer.Print(Dim + fmt.Sprintf("⚙️  Writing a changelog for %d commits since %s with Claude AI...", len(shas), since) + Reset)
+
+	ctx, cancel := apiContext(DefaultAPITimeout)
+	defer cancel()
+
+	gen, err := cs.generator(*config)
+	if err != nil {
+		return err
+	}
+	changelog, err := gen.Generate(ctx, *config, "", buildChangelogPrompt(since, subjects, preprocessDiff(diff, config.MaxLineLength)), ChangelogMaxTokens)
+	if err != nil {
+		return err
+	}
+
+	out.Print(strings.TrimSpace(changelog))
+	return nil
+}
+
+// buildChangelogPrompt asks for a changelog entry from the subjects of the
+// commits since a ref and their combined diff
+func buildChangelogPrompt(since string, subjects []string, diff string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `Write a changelog entry in Markdown for the changes since %s.
+
+IMPORTANT: Return ONLY the changelog entry, nothing else. No title, no explanations, no additional text.
+
+Group the changes under these headings, in this order, leaving out any heading with no changes:
+### Features
+### Fixes
+### Performance
+### Documentation
+### Other
+
+Guidelines:
+1. One bullet point ("- ") per change, written for users of the project rather than its developers
+2. Combine commits that make up a single change into one bullet
+3. Leave out changes users can't see, such as refactoring, tests and CI
+4. Start each bullet with a verb in the imperative mood ("Add support for..." not "Added support for...")
+5. Put breaking changes first in their group, starting with "**Breaking:**"
+`, since)
+
+	b.WriteString("\nCommits:\n")
+	for _, subject := range subjects {
+		b.WriteString("- " + subject + "\n")
+	}
+	fmt.Fprintf(&b, "\nDiff:\n%s\n", diff)
+
+	b.WriteString("\nChangelog:")
+	return b.String()
+}
+
+// runContextCommand runs the configured context command and returns its output.
+// Failures are reported as warnings so generation can continue without it.
+func (cs *CommitService) runContextCommand(command string) string {
+	if strings.TrimSpace(command) == "" {
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ContextCommandTimeout)
+	defer cancel()
+
+	name, args := shellCommand(command)
+	output, err := cs.runner.Run(ctx, name, args...)
+	if err != nil {
+		cs.printer.PrintWarning(fmt.Sprintf("Context command failed, continuing without it: %v", err))
+		return ""
+	}
+
+	return strings.TrimSpace(output)
+}
+
+// preprocessDiff prepares the staged diff for the prompt. Files whose diff
+// git suppressed are summarized, and lines longer than maxLineLength runes
+// are truncated with a marker so that minified files don't explode token usage.
+func preprocessDiff(diff string, maxLineLength int) string {
+	if maxLineLength <= 0 {
+		maxLineLength = DefaultMaxLineLength
+	}
+
+	lines := strings.Split(suppressBinaryDiffs(diff), "\n")
+	for i, line := range lines {
+		if len(line) <= maxLineLength {
+			continue
+		}
+		runes := []rune(line)
+		if len(runes) <= maxLineLength {
+			continue
+		}
+		truncated := len(runes) - maxLineLength
+		lines[i] = string(runes[:maxLineLength]) + fmt.Sprintf("…[truncated %d chars]", truncated)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// fallbackDiff describes staged changes that have no textual diff using the
+// file list and git's change summary (mode changes, creations, deletions)
+func fallbackDiff(files, summary string) string {
+	var b strings.Builder
+	b.WriteString("No textual diff is available for these changes.\n")
+	if summary = strings.TrimSpace(summary); summary != "" {
+		b.WriteString("Change summary:\n")
+		b.WriteString(summary)
+		b.WriteString("\n")
+	}
+	b.WriteString("Changed files:\n")
+	b.WriteString(strings.TrimSpace(files))
+	return b.String()
+}
+
+// SuppressedDiffNote replaces the content of files whose diff git suppressed
+const SuppressedDiffNote = "changed (diff suppressed per .gitattributes)"
+
+// suppressBinaryDiffs replaces the body of every file section that git
+// reports as binary (including files marked -diff in .gitattributes) with a
+// one-line note, keeping the "diff --git" header.
+func suppressBinaryDiffs(diff string) string {
+	if !strings.Contains(diff, "Binary files ") && !strings.Contains(diff, "GIT binary patch") {
+		return diff
+	}
+
+	var out []string
+	var section []string
+	flush := func() {
+		if len(section) == 0 {
+			return
+		}
+		if isSuppressedSection(section) && strings.HasPrefix(section[0], "diff --git ") {
+			file := strings.Join(filesFromDiff(section[0]), "")
+			out = append(out, section[0], file+": "+SuppressedDiffNote)
+		} else {
+			out = append(out, section...)
+		}
+		section = nil
+	}
+
+	for _, line := range strings.Split(diff, "\n") {
+		if strings.HasPrefix(line, "diff --git ") {
+			flush()
+		}
+		section = append(section, line)
+	}
+	flush()
+
+	return strings.Join(out, "\n")
+}
+
+// IgnoreFile lists paths, in gitignore syntax, to leave out of the prompt.
+// It lives at the repository root.
+const IgnoreFile = ".claude-commitignore"
+
+// ignorePattern is one parsed line of an ignore file
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool // Starts with !, re-including what earlier patterns excluded
+	dirOnly bool // Ends with /, so only matches directories
+}
+
+// IgnoreRules decides which changed files to leave out of the prompt. The
+// last pattern matching a path wins, as in .gitignore.
+type IgnoreRules struct {
+	patterns []ignorePattern
+}
+
+// parseIgnorePatterns reads gitignore-style lines, skipping blank lines and
+// # comments. A pattern with a slash other than a trailing one is anchored
+// to the repository root; one without matches at any depth. * and ? stop
+// at slashes, ** crosses them, and a trailing slash matches directories only.
+func parseIgnorePatterns(lines []string) *IgnoreRules {
+	rules := &IgnoreRules{}
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var p ignorePattern
+		if strings.HasPrefix(line, "!") {
+			p.negate, line = true, line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly, line = true, strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		prefix := "(?:.*/)?"
+		if strings.Contains(line, "/") {
+			prefix, line = "", strings.TrimPrefix(line, "/")
+		}
+		re, err := regexp.Compile("^" + prefix + globToRegexp(line) + "$")
+		if err != nil {
+			// Like git, skip a pattern that can't match, such as "[z-a]"
+			continue
+		}
+		p.re = re
+		rules.patterns = append(rules.patterns, p)
+	}
+	return rules
+}
+
+// globToRegexp translates a gitignore glob into a regular expression
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// add appends more patterns, which take precedence over the existing ones
+func (r *IgnoreRules) add(lines []string) {
+	r.patterns = append(r.patterns, parseIgnorePatterns(lines).patterns...)
+}
+
+func (r *IgnoreRules) empty() bool {
+	return r == nil || len(r.patterns) == 0
+}
+
+// Match reports whether path, relative to the repository root, is excluded.
+// A pattern matching one of its parent directories excludes it too.
+func (r *IgnoreRules) Match(path string) bool {
+	if r.empty() {
+		return false
+	}
+	path = strings.Trim(filepath.ToSlash(path), "/")
+	var candidates []string
+	for i, c := range path {
+		if c == '/' {
+			candidates = append(candidates, path[:i])
+		}
+	}
+	excluded := false
+	for _, p := range r.patterns {
+		matched := !p.dirOnly && p.re.MatchString(path)
+		for _, dir := range candidates {
+			matched = matched || p.re.MatchString(dir)
+		}
+		if matched {
+			excluded = !p.negate
+		}
+	}
+	return excluded
+}
+
+// filterFiles drops excluded paths from a newline-separated file list
+func (r *IgnoreRules) filterFiles(files string) string {
+	var kept []string
+	for _, file := range strings.Split(files, "\n") {
+		if file = strings.TrimSpace(file); file != "" && !r.Match(file) {
+			kept = append(kept, file)
+		}
+	}
+	if len(kept) == 0 {
+		return ""
+	}
+	return strings.Join(kept, "\n") + "\n"
+}
+
+// filterDiff drops the file sections of diff whose path is excluded
+func (r *IgnoreRules) filterDiff(diff string) string {
+	var out []string
+	var section []string
+	flush := func() {
+		if len(section) == 0 {
+			return
+		}
+		excluded := false
+		if strings.HasPrefix(section[0], "diff --git ") {
+			for _, file := range filesFromDiff(section[0]) {
+				excluded = excluded || r.Match(file)
+			}
+		}
+		if !excluded {
+			out = append(out, section...)
+		}
+		section = nil
+	}
+
+	for _, line := range strings.Split(diff, "\n") {
+		if strings.HasPrefix(line, "diff --git ") {
+			flush()
+		}
+		section = append(section, line)
+	}
+	flush()
+
+	return strings.Join(out, "\n")
+}
+
+// loadIgnoreFile parses the IgnoreFile in root. A missing file gives empty
+// rules, which exclude nothing.
+func loadIgnoreFile(fs FileSystem, root string) (*IgnoreRules, error) {
+	path := filepath.Join(root, IgnoreFile)
+	data, err := fs.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &IgnoreRules{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	return parseIgnorePatterns(strings.Split(string(data), "\n")), nil
+}
+
+func isSuppressedSection(section []string) bool {
+	for _, line := range section {
+		if line == "GIT binary patch" ||
+			(strings.HasPrefix(line, "Binary files ") && strings.HasSuffix(line, " differ")) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePromptTemplate finds the prompt template to use and describes where it
+// came from. Precedence is per-repo template, then the configured global
+// template, then the built-in prompt (returned as an empty template).
+func (cs *CommitService) resolvePromptTemplate(config Config) (string, string, error) {
+	if root, err := cs.gitClient.GetRepoRoot(); err == nil && root != "" {
+		repoTemplate := filepath.Join(root, RepoPromptTemplatePath)
+		data, err := cs.fs.ReadFile(repoTemplate)
+		if err == nil {
+			return string(data), repoTemplate, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", "", fmt.Errorf("error reading prompt template: %w", err)
+		}
+	}
+
+	if config.PromptTemplate != "" {
+		data, err := cs.fs.ReadFile(config.PromptTemplate)
+		if err != nil {
+			return "", "", fmt.Errorf("error reading prompt template: %w", err)
+		}
+		return string(data), config.PromptTemplate, nil
+	}
+
+	return "", "built-in", nil
+}
+
+func renderPromptTemplate(tmpl string, data PromptData) (string, error) {
+	t, err := template.New("prompt").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("error parsing prompt template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	err = t.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("error rendering prompt template: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+// buildSystemPrompt returns the standing instructions for a commit message:
+// the format, the types and the guidelines. They go in the system prompt so
+// they don't compete with the diff for attention.
+func (cs *CommitService) buildSystemPrompt(data PromptData) string {
+	var guidelines []string
+	if data.Rules.imperative() {
+		guidelines = append(guidelines, `Use the imperative mood ("add feature" not "Added feature")`)
+	}
+	if caseGuideline := subjectCaseGuideline(data.SubjectCase); caseGuideline != "" {
+		guidelines = append(guidelines, caseGuideline)
+	}
+	format := "<type>: <description>"
+	if data.Scope != "" {
+		format = "<type>(<scope>): <description>"
+		guidelines = append(guidelines, fmt.Sprintf("Use %q as the scope", data.Scope))
+	}
+	if data.Type != "" {
+		format = strings.Replace(format, "<type>", data.Type, 1)
+		guidelines = append(guidelines, fmt.Sprintf("Use %q as the type, whatever the diff looks like, and only write the description", data.Type))
+	} else if len(data.CustomTypes) > 0 {
+		guidelines = append(guidelines, "Only use one of the types listed above")
+	}
+	if data.Body {
+		format += "\n\n<body>"
+		guidelines = append(guidelines, `Follow the subject with a blank line and a body of 2-5 bullet points ("- ...") explaining what changed and why, wrapped at 72 characters`)
+	}
+	if data.Language != "" {
+		guidelines = append(guidelines, fmt.Sprintf("Write the description and any body in %s, but keep the type, scope and footer keys in English exactly as listed above", data.Language))
+	}
+	maxLength := data.MaxSubjectLength
+	if maxLength <= 0 {
+		maxLength = DefaultMaxSubjectLength
+	}
+	if data.Rules.noTrailingPeriod() {
+		guidelines = append(guidelines, "No period at the end")
+	}
+	guidelines = append(guidelines,
+		"Be concise but descriptive (what was changed and why)",
+		fmt.Sprintf("Maximum %d characters in the first line", maxLength),
+		breakingChangeGuideline(data.Breaking),
+	)
+	if data.Ticket != "" {
+		guidelines = append(guidelines, fmt.Sprintf("End the message with a blank line and a \"Refs: %s\" footer", data.Ticket))
+	}
+	guidelines = append(guidelines, "Return ONLY the commit message, no other text")
+
+	return fmt.Sprintf(`You write conventional commit messages for the git diffs you are given.
+
+IMPORTANT: Return ONLY the commit message, nothing else. No explanations, no analysis, no additional text.
+
+The message should follow this format: %s
+
+Types include:
+%s
+
+Guidelines:
+%s`, format, formatCommitTypes(data.CustomTypes), formatGuidelines(guidelines))
+}
+
+// buildPrompt returns the user message for a commit: any extra context,
+// the changed files and the diff
+func (cs *CommitService) buildPrompt(data PromptData) string {
+	extraContext := ""
+	if data.Context != "" {
+		extraContext = fmt.Sprintf("Additional context:\n%s\n\n", data.Context)
+	}
+	if len(data.RecentCommits) > 0 {
+		extraContext += "Recent commit messages in this repository (match their style and conventions):\n- " +
+			strings.Join(data.RecentCommits, "\n- ") + "\n\n"
+	}
+	if hint := strings.TrimSpace(data.Hint); hint != "" {
+		// Kept apart from the guidelines so a hint can steer the content
+		// of the message but not its format
+		extraContext += "Additional context from the user (use it to inform the description; the format and guidelines you were given still apply):\n" + hint + "\n\n"
+	}
+
+	untracked := ""
+	if len(data.Untracked) > 0 {
+		untracked = "\nNewly added files (untracked, so not in the diff):\n- " + strings.Join(data.Untracked, "\n- ") + "\n"
+	}
+
+	return fmt.Sprintf(`Generate a conventional commit message based on the following git diff.
+
+%sHere are the files changed:
+%s
+%s
+Here is the git diff:
+%s
+
+Commit message:`, extraContext, data.Files, untracked, data.Diff)
+}
+
+// CommitType is a conventional commit type and what it's used for
+type CommitType struct {
+	Name        string
+	Description string
+}
+
+// BuiltinCommitTypes are the types offered in the built-in prompt
+var BuiltinCommitTypes = []CommitType{
+	{"feat", "A new feature"},
+	{"fix", "A bug fix"},
+	{"docs", "Documentation changes"},
+	{"style", "Code style changes (formatting, etc.)"},
+	{"refactor", "Code refactoring without changes to functionality"},
+	{"perf", "Performance improvements"},
+	{"test", "Adding or updating tests"},
+	{"chore", "Maintenance tasks, dependency updates, etc."},
+	{"ci", "Continuous integration changes"},
+	{"build", "Changes that affect the build system or external dependencies"},
+	{"revert", "Reverts a previous commit"},
+}
+
+// formatCommitTypes lists the built-in types followed by any custom types
+// that aren't already built in
+func formatCommitTypes(customTypes []string) string {
+	var lines []string
+	seen := make(map[string]bool)
+	for _, t := range BuiltinCommitTypes {
+		lines = append(lines, fmt.Sprintf("- %s: %s", t.Name, t.Description))
+		seen[t.Name] = true
+	}
+	for _, name := range customTypes {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		lines = append(lines, fmt.Sprintf("- %s: Project-specific type, use when the change is about %s", name, name))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// validateSampling checks that a temperature or top_p value is within the
+// 0 to 1 range the API accepts
+func validateSampling(name string, value float64) error {
+	if value < 0 || value > 1 {
+		return fmt.Errorf("%s must be between 0 and 1, got %g", name, value)
+	}
+	return nil
+}
+
+var customTypePattern = regexp.MustCompile(`^[a-z]+$`)
+
+// validateCustomTypes checks that each type is a lowercase word that can
+// appear as a conventional commit prefix
+func validateCustomTypes(types []string) error {
+	for _, t := range types {
+		if !customTypePattern.MatchString(t) {
+			return fmt.Errorf("invalid commit type %q: use lowercase letters only", t)
+		}
+	}
+	return nil
+}
+
+// validateCommitType checks that t, from -type, is a built-in type or one of
+// customTypes
+func validateCommitType(t string, customTypes []string) error {
+	valid := commitTypeNames(customTypes)
+	for _, name := range valid {
+		if name == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown commit type %q: use one of %s", t, strings.Join(valid, ", "))
+}
+
+// commitTypeNames lists the built-in commit types followed by any custom
+// ones that aren't already built in
+func commitTypeNames(customTypes []string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, builtin := range BuiltinCommitTypes {
+		names = append(names, builtin.Name)
+		seen[builtin.Name] = true
+	}
+	for _, custom := range customTypes {
+		if !seen[custom] {
+			names = append(names, custom)
+			seen[custom] = true
+		}
+	}
+	return names
+}
+
+// forceCommitType rewrites the subject of msg to use type t, keeping its
+// scope, breaking marker, description and body. The prompt asks for t
+// already; this catches the model ignoring it.
+func forceCommitType(msg, t string) string {
+	subject, body, _ := strings.Cut(msg, "\n")
+	cc := parseConventionalCommit(subject)
+	if cc.Type == t {
+		return msg
+	}
+
+	subject = t
+	if cc.Scope != "" {
+		subject += "(" + cc.Scope + ")"
+	}
+	if cc.Breaking {
+		subject += "!"
+	}
+	subject += ": " + cc.Description
+	if body != "" {
+		return subject + "\n" + body
+	}
+	return subject
+}
+
+// stringListFlag is a repeatable string flag, e.g. -co-author a -co-author b
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+var coAuthorPattern = regexp.MustCompile(`^[^<>@\s][^<>@]*\s<[^<>\s@]+@[^<>\s@]+>$`)
+
+// validateCoAuthor checks that value has the "Name <email>" form git and
+// GitHub expect in a Co-authored-by trailer
+func validateCoAuthor(value string) error {
+	if !coAuthorPattern.MatchString(value) {
+		return fmt.Errorf("invalid co-author %q: expected \"Name <email>\"", value)
+	}
+	return nil
+}
+
+// coAuthorTrailers turns "Name <email>" values into Co-authored-by trailers
+func coAuthorTrailers(coAuthors []string) []string {
+	var trailers []string
+	for _, coAuthor := range coAuthors {
+		trailers = append(trailers, "Co-authored-by: "+coAuthor)
+	}
+	return trailers
+}
+
+// signoffTrailer is the Signed-off-by trailer git commit --signoff would add
+func signoffTrailer(name, email string) string {
+	return fmt.Sprintf("Signed-off-by: %s <%s>", name, email)
+}
+
+var trailerLinePattern = regexp.MustCompile(`^(?:[A-Za-z0-9-]+|BREAKING CHANGE): `)
+
+// appendTrailers adds trailers at the end of msg. They join an existing
+// trailer block such as "Refs: PROJ-123" so git sees one block; otherwise
+// they start a new paragraph.
+func appendTrailers(msg string, trailers []string) string {
+	if len(trailers) == 0 {
+		return msg
+	}
+	msg = strings.TrimRight(msg, "\n")
+	separator := "\n\n"
+	if i := strings.LastIndex(msg, "\n\n"); i >= 0 && isTrailerBlock(msg[i+2:]) {
+		separator = "\n"
+	}
+	return msg + separator + strings.Join(trailers, "\n")
+}
+
+// isTrailerBlock reports whether every line of paragraph is a git trailer
+func isTrailerBlock(paragraph string) bool {
+	for _, line := range strings.Split(paragraph, "\n") {
+		if !trailerLinePattern.MatchString(line) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// inferScope returns the top-level directory shared by every changed file,
+// or an empty string when files are at the repo root or span several
+// directories
+func inferScope(files string) string {
+	scope := ""
+	for _, file := range strings.Split(files, "\n") {
+		file = strings.TrimSpace(file)
+		if file == "" {
+			continue
+		}
+		dir, _, found := strings.Cut(file, "/")
+		if !found {
+			return ""
+		}
+		if scope != "" && dir != scope {
+			return ""
+		}
+		scope = dir
+	}
+	return scope
+}
+
+// breakingChangeGuideline asks for the ! marker and BREAKING CHANGE footer,
+// either when the diff breaks compatibility or unconditionally when forced
+func breakingChangeGuideline(forced bool) string {
+	const format = `add "!" after the type or scope (e.g. "feat!: ...") and end the message with a blank line followed by a "BREAKING CHANGE: <what breaks and how to migrate>" footer`
+	if forced {
+		return "This is a breaking change: " + format
+	}
+	return "If the diff breaks compatibility (removed or renamed public APIs, changed signatures, incompatible config or behavior), " + format
+}
+
+// formatGuidelines renders guidelines as a numbered list
+func formatGuidelines(guidelines []string) string {
+	lines := make([]string, len(guidelines))
+	for i, guideline := range guidelines {
+		lines[i] = fmt.Sprintf("%d. %s", i+1, guideline)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Subject case styles
+const (
+	SubjectCaseLower    = "lower"
+	SubjectCaseSentence = "sentence"
+	SubjectCasePreserve = "preserve"
+)
+
+func validateSubjectCase(style string) error {
+	switch style {
+	case SubjectCaseLower, SubjectCaseSentence, SubjectCasePreserve:
+		return nil
+	}
+	return fmt.Errorf("invalid subject case %q. Valid options: %s, %s, %s", style, SubjectCaseLower, SubjectCaseSentence, SubjectCasePreserve)
+}
+
+// subjectCase returns the case style to use: Config.SubjectCase when set,
+// otherwise lower, or preserve when the Lowercase rule is off
+func subjectCase(config Config) string {
+	if config.SubjectCase == "" && !config.Rules.lowercase() {
+		return SubjectCasePreserve
+	}
+	return config.SubjectCase
+}
+
+// subjectCaseGuideline returns the prompt guideline for a case style
+func subjectCaseGuideline(style string) string {
+	switch style {
+	case SubjectCaseSentence:
+		return "Start the description with a capital letter, the rest lowercase"
+	case SubjectCasePreserve:
+		return ""
+	default:
+		return "All lowercase characters"
+	}
+}
+
+// applySubjectCase sets the case of the first letter of the description in
+// the subject line. The type prefix is always lowercase.
+func applySubjectCase(msg, style string) string {
+	if style == SubjectCasePreserve {
+		return msg
+	}
+
+	subject, rest, hasRest := strings.Cut(msg, "\n")
+
+	prefix, description := "", subject
+	if loc := conventionalCommitPattern.FindStringSubmatchIndex(subject); loc != nil {
+		prefix = strings.ToLower(subject[:loc[8]])
+		description = subject[loc[8]:]
+	}
+
+	if description != "" {
+		first, size := utf8.DecodeRuneInString(description)
+		if style == SubjectCaseSentence {
+			first = unicode.ToUpper(first)
+		} else {
+			first = unicode.ToLower(first)
+		}
+		description = string(first) + description[size:]
+	}
+
+	subject = prefix + description
+	if hasRest {
+		return subject + "\n" + rest
+	}
+	return subject
+}
+
+// Commit prefix positions
+const (
+	PrefixBeforeType = "before"
+	PrefixAfterType  = "after"
+)
+
+func validatePrefixPosition(position string) error {
+	switch position {
+	case PrefixBeforeType, PrefixAfterType:
+		return nil
+	}
+	return fmt.Errorf("invalid prefix position %q. Valid options: %s, %s", position, PrefixBeforeType, PrefixAfterType)
+}
+
+// prefixPosition returns where config puts CommitPrefix, defaulting to
+// before the type
+func prefixPosition(config Config) string {
+	if config.PrefixPosition == PrefixAfterType {
+		return PrefixAfterType
+	}
+	return PrefixBeforeType
+}
+
+// applyCommitPrefix adds prefix to the subject line of msg, either before
+// everything ("[skip ci] feat: add x") or after the type and scope
+// ("feat: [skip ci] add x"), which keeps the message a valid conventional
+// commit. Subjects without a type always get it in front. A subject that
+// already has the prefix is left alone.
+func applyCommitPrefix(msg, prefix, position string) string {
+	prefix = strings.TrimSpace(prefix)
+	if prefix == "" {
+		return msg
+	}
+
+	subject, rest, hasRest := strings.Cut(msg, "\n")
+	if loc := conventionalCommitPattern.FindStringSubmatchIndex(subject); loc != nil && position == PrefixAfterType {
+		if description := subject[loc[8]:]; !strings.HasPrefix(description, prefix) {
+			subject = subject[:loc[8]] + prefix + " " + description
+		}
+	} else if !strings.HasPrefix(subject, prefix) {
+		subject = prefix + " " + subject
+	}
+
+	if hasRest {
+		return subject + "\n" + rest
+	}
+	return subject
+}
+
+// stripCommitPrefix removes a prefix added by applyCommitPrefix in either
+// position, leaving the subject the model wrote
+func stripCommitPrefix(msg, prefix string) string {
+	prefix = strings.TrimSpace(prefix)
+	if prefix == "" {
+		return msg
+	}
+
+	subject, rest, hasRest := strings.Cut(msg, "\n")
+	if trimmed, ok := strings.CutPrefix(subject, prefix+" "); ok {
+		subject = trimmed
+	} else if loc := conventionalCommitPattern.FindStringSubmatchIndex(subject); loc != nil {
+		subject = subject[:loc[8]] + strings.TrimPrefix(subject[loc[8]:], prefix+" ")
+	}
+
+	if hasRest {
+		return subject + "\n" + rest
+	}
+	return subject
+}
+
+// ConfigFileNames lists the supported config file names in lookup order.
+// The first entry is used when no config file exists yet.
+var ConfigFileNames = []string{"config.json", "config.yaml", "config.yml", "config.toml"}
+
+// ProfilesDir holds named profiles, relative to the config directory. A
+// profile uses its name in place of "config", e.g. profiles/work.json.
+const ProfilesDir = "profiles"
+
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// isConfigExt reports whether ext is the extension of a supported config format
+func isConfigExt(ext string) bool {
+	for _, name := range ConfigFileNames {
+		if filepath.Ext(name) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// Config encoding, selected by file extension
+func marshalConfig(path string, config Config) ([]byte, error) {
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		return yaml.Marshal(config)
+	case ".toml":
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(config); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return json.MarshalIndent(config, "", "  ")
+	}
+}
+
+func unmarshalConfig(path string, data []byte, config *Config) error {
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		return yaml.Unmarshal(data, config)
+	case ".toml":
+		return toml.Unmarshal(data, config)
+	default:
+		return json.Unmarshal(data, config)
+	}
+}
+
+// ConventionalCommit holds the parts of a conventional commit subject line
+type ConventionalCommit struct {
+	Type        string
+	Scope       string
+	Breaking    bool
+	Description string
+}
+
+var conventionalCommitPattern = regexp.MustCompile(`^([a-zA-Z]+)(?:\(([^)]*)\))?(!)?:\s*(.+)$`)
+
+// parseConventionalCommit splits the subject line of msg into its conventional
+// commit parts. Messages that don't follow the format are returned with only
+// the description set.
+func parseConventionalCommit(msg string) ConventionalCommit {
+	subject := strings.TrimSpace(strings.SplitN(strings.TrimSpace(msg), "\n", 2)[0])
+
+	matches := conventionalCommitPattern.FindStringSubmatch(subject)
+	if matches == nil {
+		return ConventionalCommit{Description: subject}
+	}
+
+	return ConventionalCommit{
+		Type:        strings.ToLower(matches[1]),
+		Scope:       strings.TrimSpace(matches[2]),
+		Breaking:    matches[3] == "!",
+		Description: strings.TrimSpace(matches[4]),
+	}
+}
+
+// lintTrailingPeriod is the lintMessage violation for a subject ending in a
+// period, which is dropped when the no_trailing_period rule is turned off
+const lintTrailingPeriod = "Subject line ends with a period"
+
+// lintMessage checks the subject line of msg against the conventional commit
+// format and returns a description of each problem, in a fixed order: a
+// missing type and colon, a type not in allowedTypes, a trailing period and
+// a subject longer than limit. A conforming message returns nil.
+func lintMessage(msg string, allowedTypes []string, limit int) []string {
+	var violations []string
+	cc := parseConventionalCommit(msg)
+	if cc.Type == "" {
+		violations = append(violations, "Subject doesn't start with a type and colon, e.g. \"fix: \"")
+	} else {
+		allowed := false
+		for _, t := range allowedTypes {
+			if t == cc.Type {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			violations = append(violations, fmt.Sprintf("Commit type %q isn't one of %s", cc.Type, strings.Join(allowedTypes, ", ")))
+		}
+	}
+	if strings.HasSuffix(cc.Description, ".") {
+		violations = append(violations, lintTrailingPeriod)
+	}
+	if warning := subjectLengthWarning(strings.TrimSpace(msg), limit); warning != "" {
+		violations = append(violations, warning)
+	}
+	return violations
+}
+
+// CommitOutput is the -json representation of a generated message. Type and
+// scope are empty when the message isn't a conventional commit.
+type CommitOutput struct {
+	Message     string `json:"message"`
+	Model       string `json:"model"`
+	Type        string `json:"type"`
+	Scope       string `json:"scope"`
+	Breaking    bool   `json:"breaking"`
+	Description string `json:"description"`
+	// MessageParts splits Message up with -body; nil leaves its fields out
+	*MessageParts
+}
+
+// MessageParts is a commit message split into its subject line, body and
+// trailing footers such as "Refs: PROJ-123"
+type MessageParts struct {
+	Subject string   `json:"subject"`
+	Body    string   `json:"body"`
+	Footers []string `json:"footers"`
+}
+
+// parseCommitMessage splits msg into its subject line, body and footers.
+// The footers are the last paragraph after the subject when every line of
+// it is a git trailer; everything between is the body.
+func parseCommitMessage(msg string) MessageParts {
+	msg = strings.TrimSpace(strings.ReplaceAll(msg, "\r\n", "\n"))
+	subject, rest, _ := strings.Cut(msg, "\n")
+	parts := MessageParts{Subject: strings.TrimSpace(subject), Footers: []string{}}
+
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		return parts
+	}
+	last := rest
+	if i := strings.LastIndex(rest, "\n\n"); i >= 0 {
+		last = rest[i+2:]
+	}
+	if isTrailerBlock(last) {
+		parts.Footers = strings.Split(last, "\n")
+		rest = strings.TrimSpace(strings.TrimSuffix(rest, last))
+	}
+	parts.Body = rest
+	return parts
+}
+
+// Output formats for -format
+const (
+	OutputCommand = "command" // A git commit command to copy
+	OutputPlain   = "plain"   // The message alone
+	OutputJSON    = "json"    // A CommitOutput object
+)
+
+// outputFormat returns the format asked for, with -raw and -json taking
+// precedence over -format
+func (opts GenerateOptions) outputFormat() string {
+	switch {
+	case opts.JSON:
+		return OutputJSON
+	case opts.Raw:
+		return OutputPlain
+	case opts.Format != "":
+		return opts.Format
+	}
+	return OutputCommand
+}
+
+func validateOutputFormat(format string) error {
+	switch format {
+	case OutputCommand, OutputPlain, OutputJSON:
+		return nil
+	}
+	return fmt.Errorf("invalid output format %q. Valid options: %s, %s, %s", format, OutputCommand, OutputPlain, OutputJSON)
+}
+
+// shellQuote wraps s in single quotes for a POSIX shell, so quotes, $(...)
+// and backticks in a generated message are pasted as text rather than run
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// formatOutput renders msg in format. The json format parses msg as a
+// conventional commit and includes the model that generated it, and with
+// body also its subject, body and footers.
+func formatOutput(msg, format, model string, body bool) (string, error) {
+	switch format {
+	case OutputCommand:
+		return "git commit -m " + shellQuote(msg), nil
+	case OutputPlain:
+		return msg, nil
+	case OutputJSON:
+		data, err := commitJSON(msg, model, body)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+	return "", validateOutputFormat(format)
+}
+
+// commitJSON encodes msg and the model that generated it as a JSON object.
+// With body, the subject, body and footers are included as separate fields.
+func commitJSON(msg, model string, body bool) ([]byte, error) {
+	cc := parseConventionalCommit(msg)
+	output := CommitOutput{
+		Message:     msg,
+		Model:       model,
+		Type:        cc.Type,
+		Scope:       cc.Scope,
+		Breaking:    cc.Breaking,
+		Description: cc.Description,
+	}
+	if body {
+		parts := parseCommitMessage(msg)
+		output.MessageParts = &parts
+	}
+	data, err := json.Marshal(output)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding JSON output: %w", err)
+	}
+	return data, nil
+}
+
+// MessageTemplateData is the data available to per-type message templates
+type MessageTemplateData struct {
+	Subject     string
+	Type        string
+	Scope       string
+	Breaking    bool
+	Description string
+}
+
+// selectTypeTemplate returns the template configured for commitType, falling
+// back to the "default" entry
+func selectTypeTemplate(templates map[string]string, commitType string) (string, bool) {
+	if tmpl, ok := templates[commitType]; ok && commitType != "" {
+		return tmpl, true
+	}
+	tmpl, ok := templates["default"]
+	return tmpl, ok
+}
+
+// applyTypeTemplate merges the generated message into the template configured
+// for its type. Messages without a matching template are returned unchanged.
+func applyTypeTemplate(msg string, templates map[string]string) (string, error) {
+	cc := parseConventionalCommit(msg)
+	tmpl, ok := selectTypeTemplate(templates, cc.Type)
+	if !ok {
+		return msg, nil
+	}
+
+	t, err := template.New(cc.Type).Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("error parsing template for type %q: %w", cc.Type, err)
+	}
+
+	var buf bytes.Buffer
+	err = t.Execute(&buf, MessageTemplateData{
+		Subject:     strings.TrimSpace(strings.SplitN(msg, "\n", 2)[0]),
+		Type:        cc.Type,
+		Scope:       cc.Scope,
+		Breaking:    cc.Breaking,
+		Description: cc.Description,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error rendering template for type %q: %w", cc.Type, err)
+	}
+
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// formatTrailers renders the parsed message as a git trailer block
+func formatTrailers(cc ConventionalCommit) string {
+	var lines []string
+	if cc.Type != "" {
+		lines = append(lines, "Type: "+cc.Type)
+	}
+	if cc.Scope != "" {
+		lines = append(lines, "Scope: "+cc.Scope)
+	}
+	if cc.Breaking {
+		lines = append(lines, "Breaking: true")
+	}
+	lines = append(lines, "Summary: "+cc.Description)
+	return strings.Join(lines, "\n")
+}
+
+// asciiReplacements transliterates common non-ASCII characters introduced by
+// the model. Anything not listed is stripped by toASCII.
+var asciiReplacements = map[rune]string{
+	'‘': "'", '’': "'", '‚': "'", '‛': "'", '′': "'",
+	'“': "\"", '”': "\"", '„': "\"", '‟': "\"", '″': "\"",
+	'–': "-", '—': "-", '―': "-", '‐': "-", '‑': "-", '−': "-",
+	'…': "...", '→': "->", '←': "<-", '⇒': "=>", '•': "*",
+	'\u00a0': " ", '×': "x",
+	'à': "a", 'á': "a", 'â': "a", 'ä': "a", 'ã': "a", 'å': "a",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i",
+	'ò': "o", 'ó': "o", 'ô': "o", 'ö': "o", 'õ': "o",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u",
+	'ç': "c", 'ñ': "n", 'ß': "ss",
+}
+
+// toASCII normalizes msg to plain ASCII, transliterating known characters
+// (smart quotes, dashes, accented letters) and stripping the rest (emoji).
+func toASCII(msg string) string {
+	var b strings.Builder
+	for _, r := range msg {
+		if r < 128 {
+			b.WriteRune(r)
+			continue
+		}
+		if replacement, ok := asciiReplacements[r]; ok {
+			b.WriteString(replacement)
+		}
+	}
+
+	// Stripped characters can leave doubled spaces behind
+	lines := strings.Split(b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(strings.Join(strings.Fields(line), " "))
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// userAgent returns the User-Agent header value for API requests
+func userAgent(config Config) string {
+	if config.UserAgent != "" {
+		return config.UserAgent
+	}
+	return "claude-commit/" + version
+}
+
+// sortedKeys returns the keys of m in order, for stable output
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// setExtraHeaders adds config.ExtraHeaders to req. It runs after the
+// defaults are set, so only a header the user names replaces one.
+func setExtraHeaders(req *http.Request, config Config) {
+	for name, value := range config.ExtraHeaders {
+		req.Header.Set(name, value)
+	}
+}
+
+// Providers that can generate commit messages
+const (
+	ProviderAnthropic = "anthropic"
+	ProviderOpenAI    = "openai"
+)
+
+// Providers lists the valid values of Config.Provider
+var Providers = []string{ProviderAnthropic, ProviderOpenAI}
+
+// providerNames are the display names of Providers used in error messages
+var providerNames = map[string]string{
+	ProviderAnthropic: "Anthropic",
+	ProviderOpenAI:    "OpenAI",
+}
+
+// validateProvider checks that provider is one of Providers
+func validateProvider(provider string) error {
+	for _, p := range Providers {
+		if provider == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown provider %q. Valid options: %s", provider, strings.Join(Providers, ", "))
+}
+
+// DefaultOpenAIBaseURL is used for the openai provider when no base URL is set
+const DefaultOpenAIBaseURL = "https://api.openai.com"
+
+// ChatCompletionsPath is the OpenAI-compatible endpoint relative to the base URL
+const ChatCompletionsPath = "/v1/chat/completions"
+
+type OpenAIRequest struct {
+	Model       string    `json:"model"`
+	Messages    []Message `json:"messages"`
+	MaxTokens   int       `json:"max_tokens"`
+	Temperature float64   `json:"temperature,omitempty"`
+	TopP        float64   `json:"top_p,omitempty"`
+}
+
+type OpenAIResponse struct {
+	Choices []struct {
+		Message Message `json:"message"`
+	} `json:"choices"`
+}
+
+// OpenAIService generates messages through an OpenAI-compatible chat
+// completions endpoint, such as a gateway in front of several providers
+type OpenAIService struct {
+	client           HTTPClient
+	maxResponseBytes int64
+}
+
+func NewOpenAIService(client HTTPClient) *OpenAIService {
+	return &OpenAIService{
+		client:           client,
+		maxResponseBytes: DefaultMaxResponseBytes,
+	}
+}
+
+// Generate posts prompt to the chat completions endpoint, with system as a
+// leading system message, and returns the content of the first choice
+func (oa *OpenAIService) Generate(ctx context.Context, config Config, system, prompt string, maxTokens int) (string, error) {
+	return oa.GenerateConversation(ctx, config, system, buildConversation(prompt, nil), maxTokens)
+}
+
+// openAIRoles maps the Anthropic roles used by buildConversation to their
+// chat completions names
+var openAIRoles = map[string]string{
+	AnthropicRoleUser:      OpenAIRoleUser,
+	AnthropicRoleAssistant: OpenAIRoleAssistant,
+}
+
+// GenerateConversation is Generate for a whole conversation, such as one
+// built by buildConversation, and returns the next assistant reply
+func (oa *OpenAIService) GenerateConversation(ctx context.Context, config Config, system string, conversation []Message, maxTokens int) (string, error) {
+	var messages []Message
+	if system != "" {
+		messages = append(messages, Message{Role: OpenAIRoleSystem, Content: system})
+	}
+	for _, msg := range conversation {
+		messages = append(messages, Message{Role: openAIRoles[msg.Role], Content: msg.Content})
+	}
+
+	jsonBody, err := json.Marshal(OpenAIRequest{
+		Model:       config.Model,
+		Messages:    messages,
+		MaxTokens:   maxTokens,
+		Temperature: config.Temperature,
+		TopP:        config.TopP,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %w", err)
+	}
+
+	base := config.BaseURL
+	if base == "" {
+		base = DefaultOpenAIBaseURL
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(base, "/")+ChatCompletionsPath, bytes.NewReader(jsonBody))
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+config.ApiKey)
+	req.Header.Set("User-Agent", userAgent(config))
+	setExtraHeaders(req, config)
+
+	resp, err := oa.client.Do(req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return "", fmt.Errorf("%w: %w", ErrAPITimeout, err)
+		}
+		return "", fmt.Errorf("error making API call: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, truncated, err := readLimited(resp.Body, oa.maxResponseBytes)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return "", fmt.Errorf("%w: %w", ErrAPITimeout, err)
+		}
+		return "", fmt.Errorf("error reading API response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", apiStatusError(providerNames[ProviderOpenAI], resp.StatusCode, body)
+	}
+	if truncated {
+		return "", fmt.Errorf("API response exceeds %d bytes", oa.maxResponseBytes)
+	}
+
+	return parseOpenAIResponse(body)
+}
+
+// parseOpenAIResponse returns choices[0].message.content from a chat
+// completions response
+func parseOpenAIResponse(body []byte) (string, error) {
+	var openAIResp OpenAIResponse
+	if err := json.Unmarshal(body, &openAIResp); err != nil {
+		return "", fmt.Errorf("error parsing API response: %w", err)
+	}
+	if len(openAIResp.Choices) == 0 {
+		return "", fmt.Errorf("empty response from API")
+	}
+	msg := strings.TrimSpace(openAIResp.Choices[0].Message.Content)
+	if msg == "" {
+		return "", fmt.Errorf("empty response from API")
+	}
+	return msg, nil
+}
+
+// DefaultBaseURL is the Anthropic API root that endpoint paths are appended to
+const DefaultBaseURL = "https://api.anthropic.com"
+
+// API endpoint paths relative to the base URL
+const (
+	MessagesPath = "/v1/messages"
+	ModelsPath   = "/v1/models"
+)
+
+// DefaultAPIVersion is the anthropic-version header sent unless configured
+const DefaultAPIVersion = "2023-06-01"
+
+// apiVersionPattern is the YYYY-MM-DD shape of Anthropic API versions
+var apiVersionPattern = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+
+// apiVersion returns the anthropic-version header value for config
+func apiVersion(config Config) string {
+	if config.APIVersion != "" {
+		return config.APIVersion
+	}
+	return DefaultAPIVersion
+}
+
+// apiURL returns the URL of the endpoint at path for the configured base URL
+func apiURL(config Config, path string) string {
+	base := config.BaseURL
+	if base == "" {
+		base = DefaultBaseURL
+	}
+	return strings.TrimRight(base, "/") + path
+}
+
+var languagePattern = regexp.MustCompile(`^\p{L}[\p{L}\p{M} ()-]{0,39}$`)
+
+// validateLanguage checks that value looks like a language name such as
+// "Spanish" or "pt-BR" rather than arbitrary prompt text
+func validateLanguage(value string) error {
+	if !languagePattern.MatchString(value) {
+		return fmt.Errorf("invalid language %q: use a language name like Spanish or pt-BR", value)
+	}
+	return nil
+}
+
+// DefaultTicketPattern matches Jira-style IDs such as PROJ-123
+const DefaultTicketPattern = `[A-Z][A-Z0-9]+-[0-9]+`
+
+// validateTicketPattern checks that pattern is a valid regular expression
+func validateTicketPattern(pattern string) error {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return fmt.Errorf("invalid ticket pattern %q: %w", pattern, err)
+	}
+	return nil
+}
+
+// ticketFromBranch extracts a ticket ID from a branch name such as
+// feature/PROJ-123-login, returning "" when pattern doesn't match. An empty
+// pattern uses DefaultTicketPattern; with a capture group, the first group
+// is returned instead of the whole match
+func ticketFromBranch(branch, pattern string) (string, error) {
+	if pattern == "" {
+		pattern = DefaultTicketPattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid ticket pattern %q: %w", pattern, err)
+	}
+	m := re.FindStringSubmatch(branch)
+	switch {
+	case m == nil:
+		return "", nil
+	case len(m) > 1:
+		return m[1], nil
+	default:
+		return m[0], nil
+	}
+}
+
+// validateBaseURL checks that raw is an absolute http(s) URL
+func validateBaseURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid base URL %q: %w", raw, err)
+	}
+	if u.Scheme == "" {
+		return fmt.Errorf("invalid base URL %q: missing scheme, e.g. https://", raw)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid base URL %q: scheme must be http or https", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid base URL %q: missing host", raw)
+	}
+	return nil
+}
+
+// validateUserAgent checks that ua can be sent as a header value: printable
+// ASCII only and of a reasonable length
+func validateUserAgent(ua string) error {
+	if strings.TrimSpace(ua) == "" {
+		return fmt.Errorf("user agent must not be blank")
+	}
+	if len(ua) > 256 {
+		return fmt.Errorf("user agent must be at most 256 characters, got %d", len(ua))
+	}
+	for _, r := range ua {
+		if r < ' ' || r > '~' {
+			return fmt.Errorf("user agent contains invalid character %q", r)
+		}
+	}
+	return nil
+}
+
+var headerNamePattern = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// validateExtraHeaders checks that each name is a valid HTTP header name and
+// each value fits on one line
+func validateExtraHeaders(headers map[string]string) error {
+	for _, name := range sortedKeys(headers) {
+		if !headerNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		if strings.ContainsAny(headers[name], "\r\n") {
+			return fmt.Errorf("header %s must not contain a line break", name)
+		}
 	}
+	return nil
+}
 
-	configFile := filepath.Join(homeDir, ".claude-commit", "config.json")
-	data, err := cs.fs.ReadFile(configFile)
-	if err != nil {
-		return nil, fmt.Errorf("error reading config file: %w\nPlease run 'config' first", err)
+// parseHeaders turns "Name: value" flag values into a header map
+func parseHeaders(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
 	}
-
-	var config Config
-	err = json.Unmarshal(data, &config)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing config file: %w", err)
+	headers := make(map[string]string)
+	for _, value := range values {
+		name, val, found := strings.Cut(value, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid header %q: use the form \"Name: value\"", value)
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(val)
 	}
+	return headers, validateExtraHeaders(headers)
+}
 
-	return &config, nil
+// errorSuggestions maps known errors to an actionable next step
+var errorSuggestions = map[error]string{
+	ErrConfigNotFound:  "Run 'claude_commit config -api-key \"your-api-key\"' to create a configuration",
+	ErrNoStagedChanges: "Stage changes with 'git add <files>' or 'git add -p'",
+	ErrAPIAuth:         "Check your API key and update it with 'claude_commit config -api-key \"your-api-key\"'",
+	ErrAPIRate:         "Wait a minute and try again, or retry more with 'claude_commit commit -retries 5'",
+	ErrNoUpstream:      "Set an upstream branch with 'git push -u origin <branch>' or 'git branch --set-upstream-to'",
+	ErrAPITimeout:      "Increase the timeout with 'claude_commit commit -timeout 60s'",
+	ErrAPIIncomplete:   "The connection probably dropped; try again, or retry more with 'claude_commit commit -retries 5'",
+	ErrNoCommits:       "Make a first commit before using -amend",
+	ErrSecretsDetected: "Unstage the secret, or pass -allow-secrets if it's a false positive",
+	ErrUnknownRef:      "List tags with 'git tag' and branches with 'git branch -a'",
+	ErrGitNotFound:     "Install git from https://git-scm.com/downloads, then open a new terminal so PATH picks it up",
+	ErrNoGitIdentity:   "Set them with 'git config --global user.name \"Your Name\"' and 'git config --global user.email you@example.com'",
+	ErrTooManyFiles:    "Split the change into smaller commits, or pass -force to send it anyway",
+	ErrInvalidAPIKey:   "Copy the full key from https://console.anthropic.com and save it with 'claude_commit config -api-key \"your-api-key\"'",
 }
 
-func (cs *ConfigService) ViewConfig() error {
-	config, err := cs.LoadConfig()
-	if err != nil {
-		return err
+// suggestionFor returns the suggested fix for err, or an empty string when
+// the error isn't one we know how to help with
+func suggestionFor(err error) string {
+	for target, suggestion := range errorSuggestions {
+		if errors.Is(err, target) {
+			return suggestion
+		}
 	}
+	return ""
+}
 
-	cs.printer.Print(Bold + Cyan + "Current Configuration:" + Reset)
-	cs.printer.Print(Bold + "API Key: " + Reset + MaskAPIKey(config.ApiKey))
-	cs.printer.Print(Bold + "Model: " + Reset + config.Model)
+// APIKeyPrefix starts every Anthropic API key
+const APIKeyPrefix = "sk-ant-"
+
+// MinAPIKeyLength is well under the length of a real key, so anything
+// shorter was almost certainly truncated when it was pasted
+const MinAPIKeyLength = 40
 
+// validateAPIKeyFormat catches keys that can't be valid, such as a
+// truncated paste or a key for another provider, before they reach the API
+func validateAPIKeyFormat(key string) error {
+	if strings.ContainsAny(key, " \t\r\n") {
+		return fmt.Errorf("API key contains whitespace")
+	}
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return fmt.Errorf("API key should start with %q", APIKeyPrefix)
+	}
+	if len(key) < MinAPIKeyLength {
+		return fmt.Errorf("API key is %d characters, expected at least %d; it may have been truncated", len(key), MinAPIKeyLength)
+	}
 	return nil
 }
 
-type ModelService struct {
-	configService *ConfigService
-	printer       Printer
+// usesAnthropicKey reports whether config's key goes straight to the
+// Anthropic API; gateways and other providers have their own key formats
+func usesAnthropicKey(config Config) bool {
+	return (config.Provider == "" || config.Provider == ProviderAnthropic) && config.BaseURL == ""
 }
 
-func NewModelService(configService *ConfigService, printer Printer) *ModelService {
-	return &ModelService{
-		configService: configService,
-		printer:       printer,
+// Utility functions
+func MaskAPIKey(apiKey string) string {
+	if len(apiKey) <= 8 {
+		return "********"
 	}
+	return apiKey[:4] + "****" + apiKey[len(apiKey)-4:]
 }
 
-var AvailableModels = []string{
-	"claude-opus-4-0",
-	"claude-sonnet-4-0",
-	"claude-3-7-sonnet-latest",
-	"claude-3-5-sonnet-latest",
-	"claude-3-5-haiku-latest",
-	"claude-3-opus-latest",
-}
-
-const DefaultModel = "claude-3-7-sonnet-latest"
-
-func (ms *ModelService) ShowModels() error {
-	config, err := ms.configService.LoadConfig()
-	if err != nil {
-		return err
-	}
+// LatestReleaseURL is the GitHub API endpoint for the newest published release
+const LatestReleaseURL = "https://api.github.com/repos/natrimmer/claude_commit/releases/latest"
 
-	ms.printer.Print(Bold + Cyan + "Available Models:" + Reset)
-	for _, model := range AvailableModels {
-		switch model {
-		case config.Model:
-			ms.printer.Print(Bold + Green + model + " [CURRENT]" + Reset)
-		case DefaultModel:
-			ms.printer.Print(Bold + model + " [DEFAULT]" + Reset)
-		default:
-			ms.printer.Print(Bold + model + Reset)
-		}
-	}
+// UpdateCheckTimeout bounds the request to GitHub
+const UpdateCheckTimeout = 10 * time.Second
 
-	return nil
+// GitHubRelease is the part of a GitHub release the update check needs
+type GitHubRelease struct {
+	TagName string `json:"tag_name"`
+	HTMLURL string `json:"html_url"`
 }
 
-type AnthropicService struct {
+// ReleaseChecker compares the running version against the latest release
+type ReleaseChecker struct {
 	client  HTTPClient
 	printer Printer
+	url     string
+	current string // The installed version, normally the build-time version
 }
 
-func NewAnthropicService(client HTTPClient, printer Printer) *AnthropicService {
-	return &AnthropicService{
+func NewReleaseChecker(client HTTPClient, printer Printer) *ReleaseChecker {
+	return &ReleaseChecker{
 		client:  client,
 		printer: printer,
+		url:     LatestReleaseURL,
+		current: version,
 	}
 }
 
-func (as *AnthropicService) GenerateCommitMessage(config Config, prompt string) (string, error) {
-	requestBody := AnthropicRequest{
-		Model: config.Model,
-		Messages: []Message{
-			{
-				Role:    "user",
-				Content: prompt,
-			},
-		},
-		MaxTokens: 50,
-	}
-
-	jsonBody, err := json.Marshal(requestBody)
+// Latest fetches the newest published release
+func (rc *ReleaseChecker) Latest(ctx context.Context) (*GitHubRelease, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rc.url, nil)
 	if err != nil {
-		return "", fmt.Errorf("error creating request: %w", err)
+		return nil, fmt.Errorf("error creating request: %w", err)
 	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", userAgent(Config{}))
 
-	req, err := http.NewRequest("POST", "https://api.anthropic.com/v1/messages", bytes.NewBuffer(jsonBody))
+	resp, err := rc.client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("error creating request: %w", err)
+		return nil, fmt.Errorf("error checking for updates: %w", err)
 	}
+	defer resp.Body.Close()
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-api-key", config.ApiKey)
-	req.Header.Set("anthropic-version", "2023-06-01")
-
-	resp, err := as.client.Do(req)
+	body, err := io.ReadAll(io.LimitReader(resp.Body, DefaultMaxResponseBytes))
 	if err != nil {
-		return "", fmt.Errorf("error making API call: %w", err)
+		return nil, fmt.Errorf("error reading release response: %w", err)
 	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			as.printer.PrintError(fmt.Sprintf("Error closing response body: %v", err))
-		}
-	}()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("API error (status %d): %s", resp.StatusCode, body)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("no published releases found")
 	}
-
-	var anthropicResp AnthropicResponse
-	err = json.NewDecoder(resp.Body).Decode(&anthropicResp)
-	if err != nil {
-		return "", fmt.Errorf("error parsing API response: %w", err)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GitHub API error (status %d): %s", resp.StatusCode, body)
 	}
 
-	if len(anthropicResp.Content) == 0 {
-		return "", fmt.Errorf("empty response from API")
+	var release GitHubRelease
+	if err := json.Unmarshal(body, &release); err != nil {
+		return nil, fmt.Errorf("error parsing release response: %w", err)
 	}
-
-	return anthropicResp.Content[0].Text, nil
-}
-
-type CommitService struct {
-	configService    *ConfigService
-	anthropicService *AnthropicService
-	gitClient        GitClient
-	printer          Printer
+	return &release, nil
 }
 
-func NewCommitService(configService *ConfigService, anthropicService *AnthropicService, gitClient GitClient, printer Printer) *CommitService {
-	return &CommitService{
-		configService:    configService,
-		anthropicService: anthropicService,
-		gitClient:        gitClient,
-		printer:          printer,
+// CheckForUpdate prints whether a newer release than the installed version
+// exists. Development and pre-release builds aren't compared.
+func (rc *ReleaseChecker) CheckForUpdate() error {
+	if _, prerelease, ok := parseSemver(rc.current); !ok || prerelease != "" {
+		rc.printer.Print("Development build (" + rc.current + "), update checks only work for releases")
+		return nil
 	}
-}
 
-func (cs *CommitService) GenerateCommitMessage() error {
-	config, err := cs.configService.LoadConfig()
-	if err != nil {
-		return err
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), UpdateCheckTimeout)
+	defer cancel()
 
-	diff, err := cs.gitClient.GetStagedDiff()
+	release, err := rc.Latest(ctx)
 	if err != nil {
 		return err
 	}
-
-	files, err := cs.gitClient.GetStagedFiles()
+	cmp, err := compareVersions(rc.current, release.TagName)
 	if err != nil {
 		return err
 	}
 
-	if strings.TrimSpace(diff) == "" {
-		return fmt.Errorf("no staged changes found. Use git add to stage changes")
-	}
-
-	cs.printer.Print(Dim + "⚙️  Analyzing git diff with Claude AI..." + Reset)
-
-	prompt := cs.buildPrompt(files, diff)
-
-	commitMsg, err := cs.anthropicService.GenerateCommitMessage(*config, prompt)
-	if err != nil {
-		return err
+	switch {
+	case cmp < 0:
+		rc.printer.PrintWarning(fmt.Sprintf("Update available: %s → %s", rc.current, release.TagName))
+		if release.HTMLURL != "" {
+			rc.printer.Print("Download it from " + release.HTMLURL)
+		}
+		rc.printer.Print("Or run: go install github.com/natrimmer/claude_commit@latest")
+	case cmp == 0:
+		rc.printer.PrintSuccess(fmt.Sprintf("✓ %s is the latest release", rc.current))
+	default:
+		rc.printer.Print(fmt.Sprintf("%s is newer than the latest release (%s)", rc.current, release.TagName))
 	}
-
-	commitMsg = strings.TrimSpace(commitMsg)
-	gitCommand := fmt.Sprintf("git commit -m \"%s\"", commitMsg)
-
-	cs.printer.PrintSuccess("✓ Commit message generated")
-	cs.printer.Print("")
-	cs.printer.Print(Bold + gitCommand + Reset)
-
 	return nil
 }
 
-func (cs *CommitService) buildPrompt(files, diff string) string {
-	return fmt.Sprintf(`Generate a conventional commit message based on the following git diff.
-
-IMPORTANT: Return ONLY the commit message, nothing else. No explanations, no analysis, no additional text.
-
-The message should follow this format: <type>: <description>
-
-Types include:
-- feat: A new feature
-- fix: A bug fix
-- docs: Documentation changes
-- style: Code style changes (formatting, etc.)
-- refactor: Code refactoring without changes to functionality
-- perf: Performance improvements
-- test: Adding or updating tests
-- chore: Maintenance tasks, dependency updates, etc.
-- ci: Continuous integration changes
-- build: Changes that affect the build system or external dependencies
-- revert: Reverts a previous commit
-
-Guidelines:
-1. Use the imperative mood ("add feature" not "Added feature")
-2. All lowercase characters
-3. No period at the end
-4. Be concise but descriptive (what was changed and why)
-5. Maximum 50 characters
-6. Return ONLY the commit message, no other text
-
-Here are the files changed:
-%s
-
-Here is the git diff:
-%s
+var semverPattern = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
 
-Commit message:`, files, diff)
+// parseSemver splits a version such as v1.2.3-rc.1 into its numeric core
+// and pre-release label. The leading v is optional and build metadata is
+// ignored.
+func parseSemver(v string) (core [3]int, prerelease string, ok bool) {
+	m := semverPattern.FindStringSubmatch(strings.TrimSpace(v))
+	if m == nil {
+		return core, "", false
+	}
+	for i := range core {
+		core[i], _ = strconv.Atoi(m[i+1])
+	}
+	return core, m[4], true
 }
 
-// Utility functions
-func MaskAPIKey(apiKey string) string {
-	if len(apiKey) <= 8 {
-		return "********"
+// compareVersions returns -1, 0 or 1 as a is older than, the same as or
+// newer than b. A pre-release sorts before its release, compared by label.
+func compareVersions(a, b string) (int, error) {
+	coreA, preA, okA := parseSemver(a)
+	if !okA {
+		return 0, fmt.Errorf("invalid version %q", a)
 	}
-	return apiKey[:4] + "****" + apiKey[len(apiKey)-4:]
+	coreB, preB, okB := parseSemver(b)
+	if !okB {
+		return 0, fmt.Errorf("invalid version %q", b)
+	}
+
+	for i := range coreA {
+		if coreA[i] != coreB[i] {
+			if coreA[i] < coreB[i] {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	switch {
+	case preA == preB:
+		return 0, nil
+	case preA == "":
+		return 1, nil
+	case preB == "":
+		return -1, nil
+	}
+	return strings.Compare(preA, preB), nil
 }
 
 // App struct to hold all dependencies
@@ -471,51 +6424,211 @@ type App struct {
 	configService    *ConfigService
 	modelService     *ModelService
 	commitService    *CommitService
+	hookService      *HookService
+	historyService   *HistoryService
+	doctorService    *DoctorService
+	releaseChecker   *ReleaseChecker
+	httpClient       *http.Client // Shared by the services; its timeout follows the config
 	anthropicService *AnthropicService
 	printer          Printer
 }
 
-func NewApp() *App {
+// NewApp wires the real dependencies together, printing to out and errw
+func NewApp(out, errw io.Writer, color bool) *App {
 	// Real dependencies
 	fs := &RealFileSystem{}
-	httpClient := &http.Client{}
+	httpClient := newHTTPClient(DefaultHTTPTimeout)
 	gitClient := &RealGitClient{}
-	printer := &ConsolePrinter{}
+	runner := &RealCommandRunner{}
+	printer := NewConsolePrinter(out, errw, color)
 
 	// Services
 	configService := NewConfigService(fs, printer)
+	configService.secrets = &KeyringSecretStore{}
+	configService.gitClient = gitClient
 	anthropicService := NewAnthropicService(httpClient, printer)
-	modelService := NewModelService(configService, printer)
-	commitService := NewCommitService(configService, anthropicService, gitClient, printer)
+	modelService := NewModelService(configService, anthropicService, printer)
+	commitService := NewCommitService(configService, anthropicService, gitClient, runner, fs, printer)
+	commitService.stderr = NewConsolePrinter(errw, errw, color)
+	commitService.generators[ProviderOpenAI] = NewOpenAIService(httpClient)
+	hookService := NewHookService(gitClient, fs, printer)
 
-	return &App{
+	app := &App{
 		configService:    configService,
 		modelService:     modelService,
 		commitService:    commitService,
+		hookService:      hookService,
+		historyService:   commitService.history,
+		doctorService:    NewDoctorService(configService, anthropicService, gitClient, runner, printer),
+		releaseChecker:   NewReleaseChecker(httpClient, printer),
+		httpClient:       httpClient,
 		anthropicService: anthropicService,
 		printer:          printer,
 	}
+	app.configureHTTPClient()
+	return app
+}
+
+// configureHTTPClient applies the active config's HTTP timeout. A missing or
+// unreadable config keeps the default; the command itself reports that.
+func (app *App) configureHTTPClient() {
+	if app.httpClient == nil {
+		return
+	}
+	config, _, _ := app.configService.readConfigFile()
+	app.httpClient.Timeout = httpTimeout(config)
 }
 
 // Command handlers
-func (app *App) HandleConfig(apiKey, model string) error {
-	return app.configService.SaveConfig(apiKey, model)
+func (app *App) HandleConfig(update Config, opts SaveOptions) error {
+	return app.configService.SaveConfig(update, opts)
+}
+
+// SetVerbose turns on logging of API requests and responses for every command
+func (app *App) SetVerbose(verbose bool) {
+	app.anthropicService.SetVerbose(verbose)
+}
+
+// UseConfigFile reads and writes the config at path instead of the default
+// location, for every command
+func (app *App) UseConfigFile(path string) error {
+	if err := app.configService.SetConfigFile(path); err != nil {
+		return err
+	}
+	app.configureHTTPClient()
+	return nil
+}
+
+// UseProfile selects the named config profile for the command being run
+func (app *App) UseProfile(name string) error {
+	if err := app.configService.SetProfile(name); err != nil {
+		return err
+	}
+	app.configureHTTPClient()
+	return nil
+}
+
+func (app *App) HandleProfiles() error {
+	return app.configService.ListProfiles()
+}
+
+func (app *App) HandleReset(force bool) error {
+	return app.configService.ResetConfig(force)
 }
 
 func (app *App) HandleView() error {
 	return app.configService.ViewConfig()
 }
 
-func (app *App) HandleModels() error {
-	return app.modelService.ShowModels()
+func (app *App) HandleModels(refresh, jsonOutput bool) error {
+	format := OutputPlain
+	if jsonOutput {
+		format = OutputJSON
+	}
+	return app.modelService.ShowModels(refresh, format)
+}
+
+func (app *App) HandleValidate() error {
+	return app.modelService.ValidateConfig()
+}
+
+func (app *App) HandleDoctor() error {
+	return app.doctorService.Run()
+}
+
+func (app *App) HandleHistory(n int) error {
+	return app.historyService.ShowHistory(n)
+}
+
+func (app *App) HandleUpdateCheck() error {
+	return app.releaseChecker.CheckForUpdate()
 }
 
 func (app *App) HandleHelp() {
 	app.ShowHelp()
 }
 
-func (app *App) HandleCommit() error {
-	return app.commitService.GenerateCommitMessage()
+func (app *App) HandleCommit(opts GenerateOptions) error {
+	// A diff on stdin doesn't need git to describe it
+	if !opts.Stdin {
+		if err := ensureGitAvailable(); err != nil {
+			return err
+		}
+	}
+	return app.commitService.GenerateCommitMessage(opts)
+}
+
+func (app *App) HandleInstallHook(force bool) error {
+	if err := ensureGitAvailable(); err != nil {
+		return err
+	}
+	return app.hookService.InstallHook(force)
+}
+
+func (app *App) HandleUninstallHook() error {
+	if err := ensureGitAvailable(); err != nil {
+		return err
+	}
+	return app.hookService.UninstallHook()
+}
+
+func (app *App) HandleChangelog(since string) error {
+	if err := ensureGitAvailable(); err != nil {
+		return err
+	}
+	return app.commitService.GenerateChangelog(since)
+}
+
+func (app *App) HandleSquash(commits []string) error {
+	if err := ensureGitAvailable(); err != nil {
+		return err
+	}
+	return app.commitService.GenerateSquashMessage(commits)
+}
+
+func (app *App) HandleReview() error {
+	if err := ensureGitAvailable(); err != nil {
+		return err
+	}
+	return app.commitService.ReviewUnpushedCommits()
+}
+
+// lookPath finds executables; tests replace it to simulate a missing git
+var lookPath = exec.LookPath
+
+// ensureGitAvailable returns ErrGitNotFound when there is no git executable
+// on PATH, instead of the exec error the first git command would give
+func ensureGitAvailable() error {
+	if _, err := lookPath("git"); err != nil {
+		return fmt.Errorf("%w: %w", ErrGitNotFound, err)
+	}
+	return nil
+}
+
+// Exit codes, so scripts can tell "nothing to commit" from a failure
+const (
+	ExitFailure   = 1
+	ExitNoChanges = 2
+)
+
+// exitCode returns the process exit code for a command's error
+func exitCode(err error) int {
+	if errors.Is(err, ErrNoStagedChanges) {
+		return ExitNoChanges
+	}
+	return ExitFailure
+}
+
+// ReportError prints err followed by a suggested fix when one is known
+func (app *App) ReportError(err error) {
+	msg := err.Error()
+	if code := errorCode(err); code != "" {
+		msg = "[" + code + "] " + msg
+	}
+	app.printer.PrintError(msg)
+	if suggestion := suggestionFor(err); suggestion != "" {
+		app.printer.PrintWarning("Suggestion: " + suggestion)
+	}
 }
 
 func (app *App) ShowVersion() {
@@ -535,8 +6648,39 @@ func (app *App) ShowConfigHelp() {
 	app.printer.Print("  claude_commit config [flags]")
 	app.printer.Print("")
 	app.printer.Print(Bold + "Flags:" + Reset)
+	app.printer.Print("  -allow-unknown-model")
+	app.printer.Print("                    Save a model that isn't in the known models list")
 	app.printer.Print("  -api-key string   Anthropic API key")
-	app.printer.Print("  -model string     Anthropic model to use")
+	app.printer.Print("  -base-url string  Anthropic API base URL (default " + DefaultBaseURL + ")")
+	app.printer.Print("  -api-version string")
+	app.printer.Print("                    anthropic-version header sent with API requests (default " + DefaultAPIVersion + ")")
+	app.printer.Print("  -model string     Anthropic model to use, or an alias: opus, sonnet, haiku")
+	app.printer.Print("  -provider string  API provider: anthropic (default) or openai for OpenAI-compatible endpoints")
+	app.printer.Print("  -profile string   Named profile to save to (profiles/<name>.json)")
+	app.printer.Print("  -context-cmd string")
+	app.printer.Print("                    Shell command whose output is added to the prompt as context")
+	app.printer.Print("  -prompt-template string")
+	app.printer.Print("                    Path to a text/template file replacing the built-in prompt")
+	app.printer.Print("  -types string     Comma-separated extra commit types, e.g. deps,security")
+	app.printer.Print("  -cache-ttl string  How long to reuse messages for an unchanged diff (default 24h)")
+	app.printer.Print("  -http-timeout string")
+	app.printer.Print("                    Cap on each HTTP request, e.g. 90s (default 5m)")
+	app.printer.Print("  -ticket-pattern string")
+	app.printer.Print("                    Regular expression for the ticket ID in branch names (default " + DefaultTicketPattern + ")")
+	app.printer.Print("  -max-length int   Maximum subject line length (default 50)")
+	app.printer.Print("  -max-files int    Most changed files to generate a message for (default 100)")
+	app.printer.Print("  -temperature float")
+	app.printer.Print("                    Sampling temperature between 0 and 1 (default: API default)")
+	app.printer.Print("  -top-p float      Nucleus sampling top_p between 0 and 1 (default: API default)")
+	app.printer.Print("  -lang string      Language for the description, e.g. Spanish (default English)")
+	app.printer.Print("  -subject-case string")
+	app.printer.Print("                    Description casing: lower (default), sentence or preserve")
+	app.printer.Print("  -prefix string    Text added to every subject line, e.g. \"[skip ci]\"")
+	app.printer.Print("  -prefix-position string")
+	app.printer.Print("                    Where the prefix goes: before (default) or after the type")
+	app.printer.Print("  -user-agent string")
+	app.printer.Print("                    User-Agent header sent with API requests")
+	app.printer.Print("  -header string    Extra header sent with API requests, e.g. \"X-Team: platform\" (repeatable)")
 	app.printer.Print("")
 	app.printer.Print(Bold + "Examples:" + Reset)
 	app.printer.Print("  # Initial setup (API key required)")
@@ -548,6 +6692,12 @@ func (app *App) ShowConfigHelp() {
 	app.printer.Print("  # Update only model")
 	app.printer.Print("  claude_commit config -model \"claude-3-5-sonnet-latest\"")
 	app.printer.Print("")
+	app.printer.Print("  # Add extra context to every prompt")
+	app.printer.Print("  claude_commit config -context-cmd \"cat .sprint-goal\"")
+	app.printer.Print("")
+	app.printer.Print("  # Write descriptions in Spanish")
+	app.printer.Print("  claude_commit config -lang Spanish")
+	app.printer.Print("")
 	app.printer.Print("Use 'claude_commit view' to see current configuration")
 	app.printer.Print("Use 'claude_commit models' to see available models")
 }
@@ -559,13 +6709,27 @@ func (app *App) ShowHelp() {
 	app.printer.Print(Bold + "Commands:" + Reset)
 	app.printer.Print("  config    Configure API key and model")
 	app.printer.Print("  view      View current configuration")
+	app.printer.Print("  reset     Delete the saved configuration")
+	app.printer.Print("  profiles  List named config profiles")
+	app.printer.Print("  validate  Check that the API key and model work")
+	app.printer.Print("  doctor    Diagnose setup problems")
 	app.printer.Print("  models    List available models")
 	app.printer.Print("  commit    Generate commit message")
+	app.printer.Print("  squash    Generate one message for several commits")
+	app.printer.Print("  changelog Write a changelog entry for the changes since a tag")
+	app.printer.Print("  review    Suggest better messages for unpushed commits")
+	app.printer.Print("  history   Show recently generated messages")
+	app.printer.Print("  install-hook    Install a prepare-commit-msg git hook")
+	app.printer.Print("  uninstall-hook  Remove the prepare-commit-msg git hook")
+	app.printer.Print("  update-check    Check whether a newer release is available")
 	app.printer.Print("  help      Show this help message")
 	app.printer.Print("")
 	app.printer.Print(Bold + "Flags:" + Reset)
 	app.printer.Print("  --version, -v    Show version information")
 	app.printer.Print("  --help, -h       Show this help message")
+	app.printer.Print("  --no-color       Disable colored output (also set by NO_COLOR)")
+	app.printer.Print("  --verbose        Log API requests and responses (API key masked)")
+	app.printer.Print("  --config-file    Read and write the config at this path instead")
 
 	// Show usage examples
 	app.printer.Print("\n" + Bold + "Examples:" + Reset)
@@ -573,9 +6737,69 @@ func (app *App) ShowHelp() {
 	app.printer.Print("  claude_commit config -api-key \"your-api-key\"  # Set only API key")
 	app.printer.Print("  claude_commit config -model \"claude-3-5-sonnet-latest\"  # Update only model")
 	app.printer.Print("  claude_commit view")
+	app.printer.Print("  claude_commit reset -force  # Delete the config without asking")
+	app.printer.Print("  claude_commit config -profile work -api-key \"work-api-key\"  # Save a named profile")
+	app.printer.Print("  claude_commit commit -profile work  # Use a named profile")
+	app.printer.Print("  claude_commit profiles")
+	app.printer.Print("  claude_commit validate  # Check the API key and model before relying on them")
+	app.printer.Print("  claude_commit doctor  # Check git, the repository, the config and the API key")
 	app.printer.Print("  claude_commit models")
+	app.printer.Print("  claude_commit models -refresh  # Fetch the live list from the API")
+	app.printer.Print("  claude_commit models -json  # List models as JSON for scripts")
 	app.printer.Print("  claude_commit commit")
+	app.printer.Print("  claude_commit commit -verbose  # Show the prompt template and API traffic")
+	app.printer.Print("  claude_commit commit --trailers  # Output as a git trailer block")
+	app.printer.Print("  claude_commit commit -ascii-only  # Strip emoji and smart quotes")
+	app.printer.Print("  claude_commit commit -add-all  # Stage everything (git add -A) first")
+	app.printer.Print("  claude_commit commit -all  # Stage tracked changes (git add -u) first")
+	app.printer.Print("  claude_commit commit --timings  # Show how long each phase took")
+	app.printer.Print("  claude_commit commit -apply  # Commit with the generated message")
+	app.printer.Print("  claude_commit commit -apply -no-verify  # Commit without running git hooks")
+	app.printer.Print("  claude_commit commit -apply -dry-commit  # Show the git command -apply would run")
+	app.printer.Print("  claude_commit commit -edit -apply  # Tweak the message in $EDITOR, then commit")
+	app.printer.Print("  claude_commit commit -n 3  # Choose from three candidate messages")
+	app.printer.Print("  claude_commit commit -stream  # Watch the message as it's generated")
+	app.printer.Print("  claude_commit commit -copy  # Copy the message to the clipboard")
+	app.printer.Print("  claude_commit commit -refine  # Ask for changes like \"make it shorter\"")
+	app.printer.Print("  claude_commit commit -strict -apply  # Only commit a message that passes linting")
+	app.printer.Print("  claude_commit commit -timeout 60s  # Wait longer for the API")
+	app.printer.Print("  claude_commit commit -retries 5  # Retry more when the API is overloaded")
+	app.printer.Print("  claude_commit commit -scope api  # Produce feat(api): ... style messages")
+	app.printer.Print("  claude_commit commit -type docs  # Always use the docs type")
+	app.printer.Print("  claude_commit commit -breaking  # Add ! and a BREAKING CHANGE footer")
+	app.printer.Print("  claude_commit commit -body  # Add a bulleted body explaining the change")
+	app.printer.Print("  claude_commit commit -body -wrap 100  # Wrap the body at 100 columns instead of 72")
+	app.printer.Print("  claude_commit commit -ignore-whitespace  # Hide reformatting noise from the model")
+	app.printer.Print("  claude_commit commit -include-untracked  # Mention new files you haven't added yet")
+	app.printer.Print("  claude_commit commit -exclude \"*.lock\"  # Leave lockfiles out of the prompt")
+	app.printer.Print("  git diff main | claude_commit commit -stdin  # Message for a piped diff")
+	app.printer.Print("  claude_commit commit -amend  # Reword the last commit")
+	app.printer.Print("  claude_commit commit -match-style  # Follow the style of recent commits")
+	app.printer.Print("  claude_commit commit -raw | pbcopy  # Print only the message")
+	app.printer.Print("  claude_commit commit -json  # Print the message as JSON for editors")
+	app.printer.Print("  claude_commit commit -format plain  # Choose the output: command, plain or json")
+	app.printer.Print("  claude_commit commit -hint \"mention the performance angle\"  # Nudge the message")
+	app.printer.Print("  claude_commit commit -dry-run  # Try it out without calling the API")
+	app.printer.Print("  claude_commit commit -count-tokens  # Estimate the prompt size before sending it")
+	app.printer.Print("  claude_commit commit -force  # Send the diff even if it changes too many files")
+	app.printer.Print("  claude_commit commit -allow-secrets  # Send the diff even if it looks like it has secrets")
+	app.printer.Print("  claude_commit commit -max-files 500  # Allow a bigger commit than usual")
+	app.printer.Print("  claude_commit commit -prefix \"[skip ci]\"  # Start the subject with [skip ci]")
+	app.printer.Print("  claude_commit commit -ticket-from-branch  # Add Refs: PROJ-123 from feature/PROJ-123-thing")
+	app.printer.Print("  claude_commit commit -refresh  # Regenerate instead of reusing the cached message")
+	app.printer.Print("  claude_commit commit -co-author \"Jane Doe <jane@example.com>\"  # Credit a pair")
+	app.printer.Print("  claude_commit commit -signoff  # Add a DCO Signed-off-by trailer")
+	app.printer.Print("  claude_commit commit -write  # Fill in .git/COMMIT_EDITMSG for git commit")
+	app.printer.Print("  claude_commit squash abc1234 def5678  # Message for squashing commits")
+	app.printer.Print("  claude_commit squash main..HEAD")
+	app.printer.Print("  claude_commit changelog -since v1.2.0 >> CHANGELOG.md  # Grouped Markdown changelog")
+	app.printer.Print("  claude_commit commit -against main  # Summarize everything on the branch, e.g. for a PR")
+	app.printer.Print("  claude_commit review")
+	app.printer.Print("  claude_commit history -n 20  # Show the last 20 generated messages")
+	app.printer.Print("  claude_commit install-hook  # Fill in messages on every git commit")
+	app.printer.Print("  claude_commit install-hook -force  # Back up and replace an existing hook")
 	app.printer.Print("  claude_commit --version")
+	app.printer.Print("  claude_commit update-check  # Compare against the latest GitHub release")
 
 	// Show conventional commit info
 	app.printer.Print("\n" + Bold + "Commit Types:" + Reset)
@@ -593,7 +6817,21 @@ func (app *App) ShowHelp() {
 }
 
 func main() {
-	app := NewApp()
+	// Global flags may appear anywhere; strip them before subcommand parsing
+	args, noColor := extractFlag(os.Args[1:], "no-color")
+	args, verbose := extractFlag(args, "verbose")
+	args, configFile, err := extractValueFlag(args, "config-file")
+	os.Args = append(os.Args[:1], args...)
+
+	app := NewApp(os.Stdout, os.Stderr, colorEnabled(noColor))
+	app.SetVerbose(verbose)
+	if err == nil && configFile != "" {
+		err = app.UseConfigFile(configFile)
+	}
+	if err != nil {
+		app.ReportError(err)
+		os.Exit(1)
+	}
 
 	// Handle global flags first
 	if len(os.Args) >= 2 {
@@ -610,10 +6848,104 @@ func main() {
 	configCmd := flag.NewFlagSet("config", flag.ExitOnError)
 	apiKey := configCmd.String("api-key", "", "Anthropic API key")
 	model := configCmd.String("model", DefaultModel, "Anthropic model to use")
+	contextCmd := configCmd.String("context-cmd", "", "Shell command whose output is added to the prompt as context")
+	promptTemplate := configCmd.String("prompt-template", "", "Path to a text/template file replacing the built-in prompt")
+	userAgentFlag := configCmd.String("user-agent", "", "User-Agent header sent with API requests")
+	provider := configCmd.String("provider", "", "API provider: anthropic (default) or openai for OpenAI-compatible endpoints")
+	temperature := configCmd.Float64("temperature", 0, "Sampling temperature between 0 and 1 (default: API default)")
+	topP := configCmd.Float64("top-p", 0, "Nucleus sampling top_p between 0 and 1 (default: API default)")
+	maxLength := configCmd.Int("max-length", 0, "Maximum subject line length (default 50)")
+	maxFilesConfig := configCmd.Int("max-files", 0, fmt.Sprintf("Most changed files to generate a message for (default %d)", DefaultMaxFiles))
+	subjectCase := configCmd.String("subject-case", "", "Description casing: lower (default), sentence or preserve")
+	commitPrefix := configCmd.String("prefix", "", "Text added to every subject line, e.g. \"[skip ci]\"")
+	prefixPositionFlag := configCmd.String("prefix-position", "", "Where the prefix goes: before (default) or after the type")
+	baseURL := configCmd.String("base-url", "", "Anthropic API base URL, e.g. for a gateway or proxy")
+	apiVersionFlag := configCmd.String("api-version", "", "anthropic-version header sent with API requests (default "+DefaultAPIVersion+")")
+	allowUnknownModel := configCmd.Bool("allow-unknown-model", false, "Save a model that isn't in the known models list")
+	configProfile := configCmd.String("profile", "", "Named profile to save to instead of the default config")
+	language := configCmd.String("lang", "", "Language for the description, e.g. Spanish (default English)")
+	httpTimeoutFlag := configCmd.String("http-timeout", "", "Cap on each HTTP request, e.g. 90s (default 5m)")
+	cacheTTLFlag := configCmd.String("cache-ttl", "", "How long to reuse messages for an unchanged diff, e.g. 30m (default 24h)")
+	ticketPattern := configCmd.String("ticket-pattern", "", "Regular expression for the ticket ID in branch names (default "+DefaultTicketPattern+")")
+	customTypes := configCmd.String("types", "", "Comma-separated extra commit types, e.g. deps,security")
+	var extraHeaders stringListFlag
+	configCmd.Var(&extraHeaders, "header", "Extra header sent with API requests, e.g. \"X-Team: platform\" (repeatable)")
 
 	commitCmd := flag.NewFlagSet("commit", flag.ExitOnError)
+	trailers := commitCmd.Bool("trailers", false, "Output the message as a git trailer block")
+	asciiOnly := commitCmd.Bool("ascii-only", false, "Strip or transliterate non-ASCII characters from the message")
+	addAll := commitCmd.Bool("add-all", false, "Stage all changes (git add -A) before generating")
+	all := commitCmd.Bool("all", false, "Stage modified and deleted tracked files (git add -u) before generating, like git commit -a")
+	timings := commitCmd.Bool("timings", false, "Show how long each phase took")
+	apply := commitCmd.Bool("apply", false, "Run git commit with the generated message")
+	dryCommit := commitCmd.Bool("dry-commit", false, "With -apply or -amend, print the git command that would run instead of committing")
+	noVerify := commitCmd.Bool("no-verify", false, "Pass --no-verify to git commit to skip the pre-commit and commit-msg hooks")
+	candidates := commitCmd.Int("n", 1, "Number of candidate messages to choose from")
+	timeout := commitCmd.Duration("timeout", DefaultAPITimeout, "How long to wait for the API before giving up")
+	retries := commitCmd.Int("retries", DefaultMaxRetries, "How many times to retry rate-limited or overloaded API requests")
+	scope := commitCmd.String("scope", "", "Conventional commit scope (inferred from changed paths if omitted)")
+	commitType := commitCmd.String("type", "", "Conventional commit type to use, e.g. docs (chosen by Claude if omitted)")
+	breaking := commitCmd.Bool("breaking", false, "Mark the change as breaking (! and a BREAKING CHANGE footer)")
+	stdin := commitCmd.Bool("stdin", false, "Read the diff from standard input instead of git")
+	amend := commitCmd.Bool("amend", false, "Generate a message for the last commit and offer to amend it")
+	commitProfile := commitCmd.String("profile", "", "Named profile to use instead of the default config")
+	matchStyle := commitCmd.Bool("match-style", false, "Show recent commit subjects to the model as style examples")
+	var raw bool
+	commitCmd.BoolVar(&raw, "raw", false, "Print only the message; status output goes to stderr")
+	commitCmd.BoolVar(&raw, "quiet", false, "Alias for -raw")
+	jsonOutput := commitCmd.Bool("json", false, "Print the message as a JSON object; status output goes to stderr")
+	outputFormatFlag := commitCmd.String("format", OutputCommand, "Output format: command (a git commit command), plain or json")
+	hint := commitCmd.String("hint", "", "Extra instruction for the message, e.g. \"mention the performance angle\"")
+	dryRun := commitCmd.Bool("dry-run", false, "Skip the API call and use a placeholder message built from the file list")
+	ticketFromBranchFlag := commitCmd.Bool("ticket-from-branch", false, "Add a Refs footer with the ticket ID from the branch name")
+	var coAuthors stringListFlag
+	commitCmd.Var(&coAuthors, "co-author", "Add a Co-authored-by trailer, e.g. \"Jane Doe <jane@example.com>\" (repeatable)")
+	signoffFlag := commitCmd.Bool("signoff", false, "Add a Signed-off-by trailer with your git user.name and user.email")
+	var excludes stringListFlag
+	commitCmd.Var(&excludes, "exclude", "Leave files matching this gitignore-style pattern out of the prompt, e.g. \"*.lock\" (repeatable)")
+	includeUntracked := commitCmd.Bool("include-untracked", false, "Also name new files that haven't been added yet in the prompt")
+	against := commitCmd.String("against", "", "Describe the changes since HEAD forked from this ref, e.g. main, instead of the staged changes")
+	ignoreWhitespace := commitCmd.Bool("ignore-whitespace", false, "Leave whitespace-only changes out of the diff (git diff -w)")
+	countTokens := commitCmd.Bool("count-tokens", false, "Print an estimate of the prompt size instead of generating a message")
+	body := commitCmd.Bool("body", false, "Add a bulleted body explaining the change below the subject")
+	wrap := commitCmd.Int("wrap", DefaultBodyWrap, "Column to wrap the -body text at; 0 leaves it unwrapped")
+	copyFlag := commitCmd.Bool("copy", false, "Copy the message to the clipboard instead of printing a git command")
+	strict := commitCmd.Bool("strict", false, "Fail instead of warning when the message isn't a conventional commit, ends with a period or is too long")
+	refine := commitCmd.Bool("refine", false, "Ask for changes to the message, e.g. \"make it shorter\", until you accept it")
+	stream := commitCmd.Bool("stream", false, "Print the message as it's generated")
+	edit := commitCmd.Bool("edit", false, "Open the generated message in $EDITOR before using it")
+	noCache := commitCmd.Bool("no-cache", false, "Don't read or write the message cache")
+	refreshCache := commitCmd.Bool("refresh", false, "Regenerate even if a cached message exists for this diff")
+	forceFlag := commitCmd.Bool("force", false, "Call the API even if the diff has too many files, or only deletes files or changes binaries")
+	allowSecrets := commitCmd.Bool("allow-secrets", false, "Call the API even if the diff looks like it contains secrets; the warning is still printed")
+	prefixFlag := commitCmd.String("prefix", "", "Text added to the subject line, e.g. \"[skip ci]\" (default from config)")
+	maxFilesFlag := commitCmd.Int("max-files", 0, fmt.Sprintf("Refuse to generate for more changed files than this (default from config, or %d)", DefaultMaxFiles))
+	write := commitCmd.Bool("write", false, "Write the message to the file given as an argument, or .git/COMMIT_EDITMSG")
+	styleExamples := commitCmd.Int("style-examples", DefaultStyleExamples, fmt.Sprintf("Number of recent subjects used by -match-style (max %d)", MaxStyleExamples))
+	squashCmd := flag.NewFlagSet("squash", flag.ExitOnError)
+	changelogCmd := flag.NewFlagSet("changelog", flag.ExitOnError)
+	since := changelogCmd.String("since", "", "Tag or commit to describe the changes since, e.g. v1.2.0")
+	reviewCmd := flag.NewFlagSet("review", flag.ExitOnError)
 	viewCmd := flag.NewFlagSet("view", flag.ExitOnError)
+	viewProfile := viewCmd.String("profile", "", "Named profile to show instead of the default config")
+	resetCmd := flag.NewFlagSet("reset", flag.ExitOnError)
+	force := resetCmd.Bool("force", false, "Delete without asking for confirmation")
+	resetProfile := resetCmd.String("profile", "", "Named profile to delete instead of the default config")
+	profilesCmd := flag.NewFlagSet("profiles", flag.ExitOnError)
+	historyCmd := flag.NewFlagSet("history", flag.ExitOnError)
+	historyCount := historyCmd.Int("n", DefaultHistoryEntries, "Number of recent messages to show")
+	validateCmd := flag.NewFlagSet("validate", flag.ExitOnError)
+	validateProfile := validateCmd.String("profile", "", "Named profile to check instead of the default config")
+
+	doctorCmd := flag.NewFlagSet("doctor", flag.ExitOnError)
+	doctorProfile := doctorCmd.String("profile", "", "Named profile to check instead of the default config")
 	modelsCmd := flag.NewFlagSet("models", flag.ExitOnError)
+	refresh := modelsCmd.Bool("refresh", false, "Fetch the current model list from the API")
+	modelsJSON := modelsCmd.Bool("json", false, "Print the models as a JSON array of {id, current, default} objects")
+	installHookCmd := flag.NewFlagSet("install-hook", flag.ExitOnError)
+	forceHook := installHookCmd.Bool("force", false, "Back up and replace an existing prepare-commit-msg hook")
+	uninstallHookCmd := flag.NewFlagSet("uninstall-hook", flag.ExitOnError)
+	updateCheckCmd := flag.NewFlagSet("update-check", flag.ExitOnError)
 	helpCmd := flag.NewFlagSet("help", flag.ExitOnError)
 
 	// If no arguments provided, show help instead of error
@@ -622,8 +6954,6 @@ func main() {
 		return
 	}
 
-	var err error
-
 	switch os.Args[1] {
 	case "config":
 		// If no arguments after 'config', show help
@@ -636,28 +6966,192 @@ func main() {
 			app.printer.PrintError(fmt.Sprintf("Error parsing config arguments: %v", err))
 			os.Exit(1)
 		}
-		err = app.HandleConfig(*apiKey, *model)
+		var headers map[string]string
+		if headers, err = parseHeaders(extraHeaders); err != nil {
+			app.printer.PrintError(fmt.Sprintf("Error parsing config arguments: %v", err))
+			os.Exit(1)
+		}
+		if err = app.UseProfile(*configProfile); err == nil {
+			err = app.HandleConfig(Config{
+				ApiKey:           *apiKey,
+				Model:            *model,
+				ContextCommand:   *contextCmd,
+				PromptTemplate:   *promptTemplate,
+				UserAgent:        *userAgentFlag,
+				ExtraHeaders:     headers,
+				SubjectCase:      *subjectCase,
+				CommitPrefix:     *commitPrefix,
+				PrefixPosition:   *prefixPositionFlag,
+				BaseURL:          *baseURL,
+				APIVersion:       *apiVersionFlag,
+				CustomTypes:      splitList(*customTypes),
+				MaxSubjectLength: *maxLength,
+				MaxFiles:         *maxFilesConfig,
+				Temperature:      *temperature,
+				Provider:         *provider,
+				TopP:             *topP,
+				TicketPattern:    *ticketPattern,
+				CacheTTL:         *cacheTTLFlag,
+				HTTPTimeout:      *httpTimeoutFlag,
+				Language:         *language,
+			}, SaveOptions{AllowUnknownModel: *allowUnknownModel})
+		}
+	case "reset":
+		err = resetCmd.Parse(os.Args[2:])
+		if err != nil {
+			app.printer.PrintError(fmt.Sprintf("Error parsing reset arguments: %v", err))
+			os.Exit(1)
+		}
+		if err = app.UseProfile(*resetProfile); err == nil {
+			err = app.HandleReset(*force)
+		}
+	case "profiles":
+		err = profilesCmd.Parse(os.Args[2:])
+		if err != nil {
+			app.printer.PrintError(fmt.Sprintf("Error parsing profiles arguments: %v", err))
+			os.Exit(1)
+		}
+		err = app.HandleProfiles()
 	case "view":
 		err = viewCmd.Parse(os.Args[2:])
 		if err != nil {
 			app.printer.PrintError(fmt.Sprintf("Error parsing view arguments: %v", err))
 			os.Exit(1)
 		}
-		err = app.HandleView()
+		if err = app.UseProfile(*viewProfile); err == nil {
+			err = app.HandleView()
+		}
+	case "history":
+		err = historyCmd.Parse(os.Args[2:])
+		if err != nil {
+			app.printer.PrintError(fmt.Sprintf("Error parsing history arguments: %v", err))
+			os.Exit(1)
+		}
+		err = app.HandleHistory(*historyCount)
+	case "validate":
+		err = validateCmd.Parse(os.Args[2:])
+		if err != nil {
+			app.printer.PrintError(fmt.Sprintf("Error parsing validate arguments: %v", err))
+			os.Exit(1)
+		}
+		if err = app.UseProfile(*validateProfile); err == nil {
+			err = app.HandleValidate()
+		}
+	case "doctor":
+		err = doctorCmd.Parse(os.Args[2:])
+		if err != nil {
+			app.printer.PrintError(fmt.Sprintf("Error parsing doctor arguments: %v", err))
+			os.Exit(1)
+		}
+		if err = app.UseProfile(*doctorProfile); err == nil {
+			err = app.HandleDoctor()
+		}
 	case "models":
 		err = modelsCmd.Parse(os.Args[2:])
 		if err != nil {
 			app.printer.PrintError(fmt.Sprintf("Error parsing models arguments: %v", err))
 			os.Exit(1)
 		}
-		err = app.HandleModels()
+		err = app.HandleModels(*refresh, *modelsJSON)
 	case "commit":
 		err = commitCmd.Parse(os.Args[2:])
 		if err != nil {
 			app.printer.PrintError(fmt.Sprintf("Error parsing commit arguments: %v", err))
 			os.Exit(1)
 		}
-		err = app.HandleCommit()
+		if err = app.UseProfile(*commitProfile); err == nil {
+			err = app.HandleCommit(GenerateOptions{
+				Verbose:          verbose,
+				Trailers:         *trailers,
+				AsciiOnly:        *asciiOnly,
+				AddAll:           *addAll,
+				All:              *all,
+				Timings:          *timings,
+				Apply:            *apply,
+				NoVerify:         *noVerify,
+				DryCommit:        *dryCommit,
+				Stream:           *stream,
+				Refine:           *refine,
+				Strict:           *strict,
+				Copy:             *copyFlag,
+				Candidates:       *candidates,
+				Timeout:          *timeout,
+				Retries:          *retries,
+				Scope:            *scope,
+				Type:             *commitType,
+				Breaking:         *breaking,
+				Stdin:            *stdin,
+				Amend:            *amend,
+				MatchStyle:       styleExampleCount(*matchStyle, *styleExamples),
+				Raw:              raw,
+				JSON:             *jsonOutput,
+				Format:           *outputFormatFlag,
+				Write:            *write,
+				DryRun:           *dryRun,
+				Force:            *forceFlag,
+				AllowSecrets:     *allowSecrets,
+				MaxFiles:         *maxFilesFlag,
+				Prefix:           *prefixFlag,
+				TicketFromBranch: *ticketFromBranchFlag,
+				CoAuthors:        coAuthors,
+				Signoff:          *signoffFlag,
+				NoCache:          *noCache,
+				Edit:             *edit,
+				Body:             *body,
+				Wrap:             *wrap,
+				CountTokens:      *countTokens,
+				IgnoreWhitespace: *ignoreWhitespace,
+				Against:          *against,
+				IncludeUntracked: *includeUntracked,
+				Exclude:          excludes,
+				Refresh:          *refreshCache,
+				Hint:             *hint,
+				// Only -write takes a positional argument, the message file
+				MessageFile: commitCmd.Arg(0),
+			})
+		}
+	case "changelog":
+		err = changelogCmd.Parse(os.Args[2:])
+		if err != nil {
+			app.printer.PrintError(fmt.Sprintf("Error parsing changelog arguments: %v", err))
+			os.Exit(1)
+		}
+		err = app.HandleChangelog(*since)
+	case "squash":
+		err = squashCmd.Parse(os.Args[2:])
+		if err != nil {
+			app.printer.PrintError(fmt.Sprintf("Error parsing squash arguments: %v", err))
+			os.Exit(1)
+		}
+		err = app.HandleSquash(squashCmd.Args())
+	case "review":
+		err = reviewCmd.Parse(os.Args[2:])
+		if err != nil {
+			app.printer.PrintError(fmt.Sprintf("Error parsing review arguments: %v", err))
+			os.Exit(1)
+		}
+		err = app.HandleReview()
+	case "install-hook":
+		err = installHookCmd.Parse(os.Args[2:])
+		if err != nil {
+			app.printer.PrintError(fmt.Sprintf("Error parsing install-hook arguments: %v", err))
+			os.Exit(1)
+		}
+		err = app.HandleInstallHook(*forceHook)
+	case "uninstall-hook":
+		err = uninstallHookCmd.Parse(os.Args[2:])
+		if err != nil {
+			app.printer.PrintError(fmt.Sprintf("Error parsing uninstall-hook arguments: %v", err))
+			os.Exit(1)
+		}
+		err = app.HandleUninstallHook()
+	case "update-check":
+		err = updateCheckCmd.Parse(os.Args[2:])
+		if err != nil {
+			app.printer.PrintError(fmt.Sprintf("Error parsing update-check arguments: %v", err))
+			os.Exit(1)
+		}
+		err = app.HandleUpdateCheck()
 	case "help":
 		err = helpCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -672,7 +7166,7 @@ func main() {
 	}
 
 	if err != nil {
-		app.printer.PrintError(err.Error())
-		os.Exit(1)
+		app.ReportError(err)
+		os.Exit(exitCode(err))
 	}
 }